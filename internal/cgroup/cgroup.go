@@ -0,0 +1,255 @@
+// Package cgroup reads cpu and memory accounting of the cgroup (v1 or v2) this process belongs to.
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultRoot ... mount point of cgroup filesystem
+const DefaultRoot = "/sys/fs/cgroup"
+
+// Version ... cgroup version
+type Version int
+
+// cgroup versions
+const (
+	None Version = 0
+	V1   Version = 1
+	V2   Version = 2
+)
+
+// v1 で制限なしの場合 limit_in_bytes にはページ境界に丸めた int64 の最大値が入る
+const v1Unlimited = math.MaxInt64 / 4096 * 4096
+
+// Stats ... cumulative cpu usage and memory of cgroup
+type Stats struct {
+	CPUUsage    uint64  `json:"cpuusage"`    // microseconds
+	CPUQuota    float64 `json:"cpuquota"`    // cores (0: unlimited)
+	MemoryUsage uint64  `json:"memoryusage"` // bytes (without inactive file cache)
+	MemoryLimit uint64  `json:"memorylimit"` // bytes (0: unlimited)
+}
+
+// Reader ... reads accounting files of one cgroup
+type Reader struct {
+	Version Version
+	cpuDir  string // cpu.max (v2), cpu.cfs_* (v1)
+	acctDir string // cpuacct.usage (v1)
+	memDir  string
+}
+
+// Option ... settings of Reader
+// Root は cgroup のマウントポイント、ProcRoot は /proc/self/cgroup を読むための procfs のパス
+type Option struct {
+	Root     string
+	ProcRoot string
+}
+
+// New ... detect cgroup version and directories of this process
+// returns Reader with Version None when cgroup is not available
+func New(opt Option) *Reader {
+	if opt.Root == "" {
+		opt.Root = DefaultRoot
+	}
+	if opt.ProcRoot == "" {
+		opt.ProcRoot = "/proc"
+	}
+	paths := readProcCgroup(filepath.Join(opt.ProcRoot, "self", "cgroup"))
+
+	if exists(filepath.Join(opt.Root, "cgroup.controllers")) {
+		dir := resolveDir(opt.Root, paths[""])
+		return &Reader{Version: V2, cpuDir: dir, acctDir: dir, memDir: dir}
+	}
+	// v1 の cpu と cpuacct は別の階層にマウントされることがあり、パスも一致するとは限らない
+	cpuRoot := firstExisting(filepath.Join(opt.Root, "cpu,cpuacct"), filepath.Join(opt.Root, "cpu"))
+	acctRoot := firstExisting(filepath.Join(opt.Root, "cpu,cpuacct"), filepath.Join(opt.Root, "cpuacct"))
+	memRoot := firstExisting(filepath.Join(opt.Root, "memory"))
+	if cpuRoot == "" || acctRoot == "" || memRoot == "" {
+		return &Reader{Version: None}
+	}
+	return &Reader{
+		Version: V1,
+		cpuDir:  resolveDir(cpuRoot, paths["cpu"]),
+		acctDir: resolveDir(acctRoot, paths["cpuacct"]),
+		memDir:  resolveDir(memRoot, paths["memory"]),
+	}
+}
+
+// Read ... current accounting values
+func (r *Reader) Read() (Stats, error) {
+	switch r.Version {
+	case V2:
+		return r.readV2()
+	case V1:
+		return r.readV1()
+	}
+	return Stats{}, fmt.Errorf("cgroup not available")
+}
+
+func (r *Reader) readV2() (Stats, error) {
+	stats := Stats{}
+	cpuStat, err := readKeyValues(filepath.Join(r.cpuDir, "cpu.stat"))
+	if err != nil {
+		return stats, err
+	}
+	stats.CPUUsage = cpuStat["usage_usec"]
+
+	// cpu.max: "<quota> <period>" (quota は max で制限なし)
+	if fields, err := readFields(filepath.Join(r.cpuDir, "cpu.max")); err == nil && len(fields) == 2 && fields[0] != "max" {
+		quota, _ := strconv.ParseFloat(fields[0], 64)
+		period, _ := strconv.ParseFloat(fields[1], 64)
+		if period > 0 {
+			stats.CPUQuota = quota / period
+		}
+	}
+
+	if stats.MemoryUsage, err = readUint(filepath.Join(r.memDir, "memory.current")); err != nil {
+		return stats, err
+	}
+	if fields, err := readFields(filepath.Join(r.memDir, "memory.max")); err == nil && len(fields) == 1 && fields[0] != "max" {
+		stats.MemoryLimit, _ = strconv.ParseUint(fields[0], 10, 64)
+	}
+	if memStat, err := readKeyValues(filepath.Join(r.memDir, "memory.stat")); err == nil {
+		stats.MemoryUsage = subtract(stats.MemoryUsage, memStat["inactive_file"])
+	}
+	return stats, nil
+}
+
+func (r *Reader) readV1() (Stats, error) {
+	stats := Stats{}
+	usage, err := readUint(filepath.Join(r.acctDir, "cpuacct.usage"))
+	if err != nil {
+		return stats, err
+	}
+	stats.CPUUsage = usage / 1000 // nanoseconds
+
+	quota, errQuota := readInt(filepath.Join(r.cpuDir, "cpu.cfs_quota_us"))
+	period, errPeriod := readInt(filepath.Join(r.cpuDir, "cpu.cfs_period_us"))
+	if errQuota == nil && errPeriod == nil && quota > 0 && period > 0 {
+		stats.CPUQuota = float64(quota) / float64(period)
+	}
+
+	if stats.MemoryUsage, err = readUint(filepath.Join(r.memDir, "memory.usage_in_bytes")); err != nil {
+		return stats, err
+	}
+	if limit, err := readUint(filepath.Join(r.memDir, "memory.limit_in_bytes")); err == nil && limit < v1Unlimited {
+		stats.MemoryLimit = limit
+	}
+	if memStat, err := readKeyValues(filepath.Join(r.memDir, "memory.stat")); err == nil {
+		stats.MemoryUsage = subtract(stats.MemoryUsage, memStat["total_inactive_file"])
+	}
+	return stats, nil
+}
+
+// readProcCgroup ... controller -> path of /proc/self/cgroup ("" is the v2 unified hierarchy)
+func readProcCgroup(path string) map[string]string {
+	paths := map[string]string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return paths
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			paths[""] = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	return paths
+}
+
+// resolveDir ... cgroup directory of this process
+// cgroup namespace が有効なコンテナ内ではマウントポイント自体が自身の cgroup となる
+func resolveDir(root, path string) string {
+	if path != "" && path != "/" {
+		if dir := filepath.Join(root, path); exists(dir) {
+			return dir
+		}
+	}
+	return root
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func firstExisting(paths ...string) string {
+	for _, path := range paths {
+		if exists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func readFields(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+func readUint(path string) (uint64, error) {
+	fields, err := readFields(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) != 1 {
+		return 0, fmt.Errorf("unexpected format of %s", path)
+	}
+	return strconv.ParseUint(fields[0], 10, 64)
+}
+
+func readInt(path string) (int64, error) {
+	fields, err := readFields(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) != 1 {
+		return 0, fmt.Errorf("unexpected format of %s", path)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+func readKeyValues(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+func subtract(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
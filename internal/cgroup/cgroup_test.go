@@ -0,0 +1,98 @@
+package cgroup
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testdata/<name>/cgroup ... cgroup のマウントポイント, testdata/<name>/proc ... /proc/self/cgroup を含む procfs
+func newTestReader(name string) *Reader {
+	return New(Option{Root: filepath.Join("testdata", name, "cgroup"), ProcRoot: filepath.Join("testdata", name, "proc")})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		version Version
+		cpuDir  string
+		acctDir string
+		memDir  string
+	}{
+		{"v2", V2, "v2/cgroup/system.slice/app.service", "v2/cgroup/system.slice/app.service", "v2/cgroup/system.slice/app.service"},
+		{"v2-unlimited", V2, "v2-unlimited/cgroup", "v2-unlimited/cgroup", "v2-unlimited/cgroup"},
+		// cpu.cfs_* は cpu コントローラ、cpuacct.usage は cpuacct コントローラのパスから読む
+		{"v1", V1, "v1/cgroup/cpu/docker/abc", "v1/cgroup/cpuacct/docker/acct", "v1/cgroup/memory/docker/abc"},
+		{"v1-unlimited", V1, "v1-unlimited/cgroup/cpu,cpuacct", "v1-unlimited/cgroup/cpu,cpuacct", "v1-unlimited/cgroup/memory"},
+		{"none", None, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestReader(tt.name)
+			if r.Version != tt.version {
+				t.Errorf("Version = %d, want %d", r.Version, tt.version)
+			}
+			for _, dir := range []struct{ got, want string }{{r.cpuDir, tt.cpuDir}, {r.acctDir, tt.acctDir}, {r.memDir, tt.memDir}} {
+				want := dir.want
+				if want != "" {
+					want = filepath.Join("testdata", want)
+				}
+				if dir.got != want {
+					t.Errorf("dir = %s, want %s", dir.got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInNamespace(t *testing.T) {
+	// /proc/self/cgroup のパスがマウントポイント配下に存在しない場合はマウントポイントを使う
+	r := New(Option{Root: "testdata/v2-unlimited/cgroup", ProcRoot: "testdata/namespaced/proc"})
+	if r.Version != V2 || r.cpuDir != "testdata/v2-unlimited/cgroup" {
+		t.Errorf("Reader = %+v, want v2 on mount point", r)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Stats
+		wantErr bool
+	}{
+		// memory.current 512MiB - inactive_file 128MiB
+		{"v2", Stats{CPUUsage: 5000000, CPUQuota: 1.5, MemoryUsage: 384 << 20, MemoryLimit: 1 << 30}, false},
+		// cpu.max / memory.max が max の場合は制限なし、inactive_file が usage を超える場合は 0
+		{"v2-unlimited", Stats{CPUUsage: 42}, false},
+		// cpuacct.usage はナノ秒、usage 200MiB - total_inactive_file 50MiB
+		{"v1", Stats{CPUUsage: 7000000, CPUQuota: 0.5, MemoryUsage: 150 << 20, MemoryLimit: 256 << 20}, false},
+		// cfs_quota_us=-1 と limit_in_bytes の最大値は制限なし
+		{"v1-unlimited", Stats{CPUUsage: 1}, false},
+		{"none", Stats{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTestReader(tt.name).Read()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Read() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProcCgroup(t *testing.T) {
+	paths := readProcCgroup("testdata/v1/proc/self/cgroup")
+	want := map[string]string{"memory": "/docker/abc", "cpuacct": "/docker/acct", "cpu": "/docker/abc", "name=systemd": "/docker/abc"}
+	if len(paths) != len(want) {
+		t.Errorf("readProcCgroup() = %v, want %v", paths, want)
+	}
+	for controller, path := range want {
+		if paths[controller] != path {
+			t.Errorf("readProcCgroup()[%s] = %s, want %s", controller, paths[controller], path)
+		}
+	}
+	if paths := readProcCgroup("testdata/missing"); len(paths) != 0 {
+		t.Errorf("readProcCgroup(missing) = %v, want empty", paths)
+	}
+}
@@ -0,0 +1,94 @@
+// Package cpuload places short bursts of load on every core and adjusts their interval so that cpu usage follows a target.
+package cpuload
+
+import (
+	"runtime"
+	"time"
+)
+
+// 目標値と現在値を比較して負荷の間隔を調整する周期(ミリ秒)
+const tickerGlobal = 100
+
+// 1 回の負荷をかける時間(ミリ秒)
+const burst = 10
+
+// Run ... keep usage returned by current close to target (percent)
+// target が 0 の間は負荷をかけない。呼び出した goroutine で動き続ける
+func Run(target, current func() float64) {
+	started := false
+	t := time.NewTicker(time.Duration(tickerGlobal) * time.Millisecond)
+	defer t.Stop()
+	quit := make(chan bool)
+	ratio := make(chan float64)
+	for {
+		<-t.C
+		cpuUsage := target()
+		if cpuUsage == 0 {
+			if started {
+				started = false
+				quit <- true
+			}
+			continue
+		}
+		if !started {
+			started = true
+			go cpuUsageController(ratio, quit)
+			continue
+		}
+		curCPUUsage := current()
+		if curCPUUsage < cpuUsage {
+			ratio <- 1 - (cpuUsage-curCPUUsage)/1000
+		} else {
+			ratio <- 1 + (curCPUUsage-cpuUsage)/1000
+		}
+	}
+}
+
+// cpuUsageController ... place load at interval multiplied by ratio until quit
+func cpuUsageController(ratio chan float64, quit chan bool) {
+	interval := float64(1000)
+	prevInterval := interval
+	t := time.NewTicker(time.Duration(interval) * time.Millisecond)
+
+	for {
+		select {
+		case <-t.C:
+			done := make(chan int)
+			go placeLoad(done)
+			go stopTimer(done)
+		case newRatio := <-ratio:
+			if prevInterval != newRatio*interval {
+				interval *= newRatio
+				prevInterval = interval
+				if interval > 1.0 {
+					t.Stop()
+					t = time.NewTicker(time.Duration(interval) * time.Millisecond)
+				}
+			}
+		case <-quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+func stopTimer(done chan int) {
+	time.Sleep(burst * time.Millisecond)
+	close(done)
+}
+
+func placeLoad(done chan int) {
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go func() {
+			x := 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					x++
+				}
+			}
+		}()
+	}
+}
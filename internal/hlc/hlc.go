@@ -0,0 +1,100 @@
+// Package hlc implements hybrid logical clocks which order events across hosts regardless of clock skew.
+package hlc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp ... hybrid logical clock timestamp
+// Wall は物理時刻(UnixNano)の最大値、Logical は同じ Wall での順序
+type Timestamp struct {
+	Wall    int64 `json:"wall"`
+	Logical int32 `json:"logical"`
+}
+
+// Less ... t happened before o
+func (t Timestamp) Less(o Timestamp) bool {
+	if t.Wall != o.Wall {
+		return t.Wall < o.Wall
+	}
+	return t.Logical < o.Logical
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.Wall, t.Logical)
+}
+
+// Clock ... hybrid logical clock of this node
+// 送信とローカルの更新では Now、受信では Update を呼ぶ
+type Clock struct {
+	*sync.Mutex
+	last     Timestamp
+	physical func() int64
+}
+
+// NewClock ... clock driven by physical time of this host
+func NewClock() *Clock {
+	return NewClockWithSource(func() int64 { return time.Now().UnixNano() })
+}
+
+// NewClockWithSource ... clock driven by physical time (UnixNano) returned by source
+// 時計のずれたノードを再現する場合に使う
+func NewClockWithSource(source func() int64) *Clock {
+	return &Clock{Mutex: &sync.Mutex{}, physical: source}
+}
+
+// Now ... timestamp for local event or send
+func (c *Clock) Now() Timestamp {
+	c.Lock()
+	defer c.Unlock()
+	pt := c.physical()
+	if pt > c.last.Wall {
+		c.last = Timestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update ... timestamp for receive of remote timestamp
+func (c *Clock) Update(remote Timestamp) Timestamp {
+	c.Lock()
+	defer c.Unlock()
+	pt := c.physical()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last = Timestamp{Wall: pt}
+	case c.last.Wall == remote.Wall:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	}
+	return c.last
+}
+
+// PeerSkew ... clock offset of peer observed by this node
+// Offset は相手の物理時刻 - 自ノードの物理時刻(往復時間の中間で推定)
+// 受信後の HLC の Wall は進んでいる側の時計に揃うため、相手の物理時刻は HLC とは別に受け取ること
+// Stale は HLC が古すぎるために拒否した相手のメッセージの数
+type PeerSkew struct {
+	Offset     float64 `json:"offset_ms"`
+	RTT        float64 `json:"rtt_ms"`
+	ObservedAt int64   `json:"observed_at"`
+	Stale      int64   `json:"stale,omitempty"`
+}
+
+// NewPeerSkew ... skew from remote physical time received between sentAt and receivedAt
+func NewPeerSkew(remotePhysical, sentAt, receivedAt int64) PeerSkew {
+	return PeerSkew{
+		Offset:     float64(remotePhysical-(sentAt+receivedAt)/2) / 1000000,
+		RTT:        float64(receivedAt-sentAt) / 1000000,
+		ObservedAt: receivedAt,
+	}
+}
@@ -0,0 +1,78 @@
+package hlc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNowIsMonotonic(t *testing.T) {
+	c := NewClock()
+	prev := c.Now()
+	for i := 0; i < 1000; i++ {
+		cur := c.Now()
+		if !prev.Less(cur) {
+			t.Fatalf("Now() = %v, want after %v", cur, prev)
+		}
+		prev = cur
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	now := time.Now().UnixNano()
+	ahead := now + int64(time.Hour)
+	tests := []struct {
+		name   string
+		remote Timestamp
+		check  func(local, remote, got Timestamp) bool
+	}{
+		// 相手の時計が進んでいる場合は相手の Wall を引き継いで Logical を進める
+		{"remote ahead", Timestamp{Wall: ahead, Logical: 3}, func(local, remote, got Timestamp) bool {
+			return got == Timestamp{Wall: ahead, Logical: 4}
+		}},
+		// 相手の時計が遅れている場合は自ノードの物理時刻を使う
+		{"remote behind", Timestamp{Wall: now - int64(time.Hour), Logical: 9}, func(local, remote, got Timestamp) bool {
+			return local.Less(got) && got.Logical == 0
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClock()
+			local := c.Now()
+			got := c.Update(tt.remote)
+			if !tt.check(local, tt.remote, got) || !tt.remote.Less(got) || !local.Less(got) {
+				t.Errorf("Update(%v) = %v (local %v)", tt.remote, got, local)
+			}
+			// 受信後のイベントは受信したタイムスタンプより後になる
+			if next := c.Now(); !got.Less(next) {
+				t.Errorf("Now() = %v, want after %v", next, got)
+			}
+		})
+	}
+}
+
+func TestNewPeerSkew(t *testing.T) {
+	skew := NewPeerSkew(int64(25*time.Millisecond), 0, int64(10*time.Millisecond))
+	if skew.Offset != 20 || skew.RTT != 10 || skew.ObservedAt != int64(10*time.Millisecond) {
+		t.Errorf("NewPeerSkew() = %+v, want offset 20ms rtt 10ms", skew)
+	}
+}
+
+func TestLaggingPeer(t *testing.T) {
+	lag := int64(5 * time.Second)
+	local := NewClock()
+	peer := NewClockWithSource(func() int64 { return time.Now().UnixNano() - lag })
+	for i := 0; i < 3; i++ {
+		sentAt := time.Now().UnixNano()
+		// 遅れている相手の HLC は受信後にこちらの Wall に追いつくが、物理時刻は遅れたまま
+		remote := peer.Update(local.Now())
+		physical := peer.physical()
+		receivedAt := time.Now().UnixNano()
+		local.Update(remote)
+		if remote.Wall < sentAt {
+			t.Errorf("wall of peer = %d, want >= %d after receive", remote.Wall, sentAt)
+		}
+		if skew := NewPeerSkew(physical, sentAt, receivedAt); skew.Offset > -4900 || skew.Offset < -5100 {
+			t.Errorf("round %d: offset = %vms, want about -5000ms", i, skew.Offset)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package netaddr lists interface addresses and parses host/client addresses of IPv4, IPv6 and dual-stack networks.
+package netaddr
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// address families
+const (
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+)
+
+// scopes of address (Primary はこの順に優先する)
+const (
+	ScopeGlobal    = "global"
+	ScopePrivate   = "private"
+	ScopeLinkLocal = "linklocal"
+	ScopeLoopback  = "loopback"
+)
+
+var scopeRank = map[string]int{ScopeGlobal: 0, ScopePrivate: 0, ScopeLinkLocal: 1, ScopeLoopback: 2}
+
+// RFC1918 と ULA(fc00::/7)
+var privateNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
+
+// Address ... address assigned to network interface
+// リンクローカルの IPv6 アドレスにはインタフェース名をゾーン ID として付ける(fe80::1%eth0)
+type Address struct {
+	Interface string `json:"interface"`
+	IP        string `json:"ip"`
+	Family    string `json:"family"`
+	Prefix    int    `json:"prefix"`
+	Scope     string `json:"scope"`
+	index     int
+}
+
+// Interfaces ... addresses of every interface which is up, sorted by interface index, family and address
+func Interfaces() ([]Address, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := []Address{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ifaddr := range ifaddrs {
+			ipnet, ok := ifaddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			prefix, _ := ipnet.Mask.Size()
+			addr := Address{
+				Interface: iface.Name,
+				IP:        ipnet.IP.String(),
+				Family:    Family(ipnet.IP),
+				Prefix:    prefix,
+				Scope:     scope(ipnet.IP),
+				index:     iface.Index,
+			}
+			if addr.Family == IPv6 && addr.Scope == ScopeLinkLocal {
+				addr.IP += "%" + iface.Name
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		if addrs[i].index != addrs[j].index {
+			return addrs[i].index < addrs[j].index
+		}
+		return addrs[i].Family < addrs[j].Family
+	})
+	return addrs, nil
+}
+
+// Primary ... address which represents the host (empty: no address other than loopback)
+// スコープ(global/private > linklocal)、family で指定したアドレスファミリ、インタフェースの順で選ぶ
+func Primary(addrs []Address, family string) string {
+	best := -1
+	rank := func(addr Address) int {
+		r := scopeRank[addr.Scope] * 2
+		if addr.Family != family {
+			r++
+		}
+		return r
+	}
+	for i, addr := range addrs {
+		if addr.Scope == ScopeLoopback {
+			continue
+		}
+		if best < 0 || rank(addr) < rank(addrs[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return addrs[best].IP
+}
+
+// Family ... address family of ip (IPv4-mapped IPv6 address is ipv4)
+func Family(ip net.IP) string {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+func scope(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return ScopeLoopback
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return ScopeLinkLocal
+	}
+	for _, private := range privateNets {
+		if private.Contains(ip) {
+			return ScopePrivate
+		}
+	}
+	return ScopeGlobal
+}
+
+// Host ... address without port and brackets, or addr itself if it is not an ip address (hostname など)
+// "1.2.3.4:80", "[2001:db8::1]:80", "2001:DB8::1", "[fe80::1%25eth0]:80" などを受け付け、
+// IPv6 は正規化した表記にしてゾーン ID を残す(fe80::1%eth0)
+func Host(addr string) string {
+	addr = strings.TrimSpace(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	ip, zone := splitZone(host)
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return host
+	}
+	if zone != "" {
+		return parsed.String() + "%" + zone
+	}
+	return parsed.String()
+}
+
+// splitZone ... ip and zone id (URL エンコードされた %25 も受け付ける)
+func splitZone(host string) (string, string) {
+	i := strings.LastIndex(host, "%")
+	if i < 0 {
+		return host, ""
+	}
+	zone := host[i+1:]
+	if strings.HasPrefix(zone, "25") && len(zone) > 2 && strings.Contains(host[:i], ":") {
+		zone = zone[2:]
+	}
+	return host[:i], zone
+}
+
+// SplitXFF ... addresses of X-Forwarded-For header values (ポート付きや角括弧付きの IPv6 も Host で正規化する)
+func SplitXFF(values ...string) []string {
+	xff := []string{}
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				xff = append(xff, Host(entry))
+			}
+		}
+	}
+	return xff
+}
+
+// Equal ... whether a and b are the same address (ip でなければ文字列として比較する)
+func Equal(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ipA, zoneA := splitZone(Host(a))
+	ipB, zoneB := splitZone(Host(b))
+	parsedA, parsedB := net.ParseIP(ipA), net.ParseIP(ipB)
+	return parsedA != nil && parsedB != nil && parsedA.Equal(parsedB) && zoneA == zoneB
+}
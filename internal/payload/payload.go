@@ -0,0 +1,157 @@
+// Package payload generates response bodies of given size which can be reproduced from a seed.
+package payload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Mode ... kind of generated payload
+type Mode string
+
+// modes
+const (
+	Text    Mode = "text"    // random letters
+	Pattern Mode = "pattern" // repeating pattern
+	Binary  Mode = "binary"  // random bytes (incompressible)
+	Zeros   Mode = "zeros"   // zero bytes (highly compressible)
+	JSON    Mode = "json"    // valid json document
+)
+
+// headers of response carrying payload
+const (
+	ChecksumHeader = "X-Payload-Sha256"
+	SeedHeader     = "X-Payload-Seed"
+)
+
+// DefaultPattern ... pattern repeated when Option.Pattern is empty
+const DefaultPattern = "0123456789abcdefghijklmnopqrstuvwxyz\n"
+
+const (
+	letterBytes   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	letterIdxBits = 6                    // 6 bits to represent a letter index
+	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
+	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
+)
+
+var contentTypes = map[Mode]string{
+	Text:    "text/plain; charset=utf-8",
+	Pattern: "text/plain; charset=utf-8",
+	Binary:  "application/octet-stream",
+	Zeros:   "application/octet-stream",
+	JSON:    "application/json",
+}
+
+// ParseMode ... mode of name (ok is false for unknown name)
+func ParseMode(name string) (Mode, bool) {
+	_, ok := contentTypes[Mode(name)]
+	return Mode(name), ok
+}
+
+// ContentType ... Content-Type header value of mode
+func (m Mode) ContentType() string {
+	return contentTypes[m]
+}
+
+// Option ... settings of generator
+// Seed が 0 の場合は現在時刻から決めた seed を使う(Generator.Seed で参照できる)
+type Option struct {
+	Mode    Mode
+	Seed    int64
+	Pattern string
+}
+
+// Generator ... payload generator of one response
+type Generator struct {
+	Mode    Mode
+	Seed    int64
+	pattern string
+	src     *rand.Rand
+}
+
+// New ... generator of opt
+func New(opt Option) *Generator {
+	if opt.Mode == "" {
+		opt.Mode = Text
+	}
+	if opt.Seed == 0 {
+		opt.Seed = time.Now().UnixNano()
+	}
+	if opt.Pattern == "" {
+		opt.Pattern = DefaultPattern
+	}
+	return &Generator{opt.Mode, opt.Seed, opt.Pattern, rand.New(rand.NewSource(opt.Seed))}
+}
+
+// Generate ... next n bytes of payload
+// 同じ seed の Generator は同じ順序で呼び出せば同じ内容を返す
+func (g *Generator) Generate(n int) []byte {
+	if n <= 0 {
+		return []byte{}
+	}
+	switch g.Mode {
+	case Pattern:
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = g.pattern[i%len(g.pattern)]
+		}
+		return b
+	case Binary:
+		b := make([]byte, n)
+		g.src.Read(b)
+		return b
+	case Zeros:
+		return make([]byte, n)
+	case JSON:
+		return g.json(n)
+	}
+	return g.letters(n)
+}
+
+// json ... {"data":"..."} padded to n bytes (短い場合は空オブジェクトと空白で埋める)
+func (g *Generator) json(n int) []byte {
+	const prefix, suffix = `{"data":"`, `"}`
+	if n >= len(prefix)+len(suffix) {
+		b := append([]byte(prefix), g.letters(n-len(prefix)-len(suffix))...)
+		return append(b, suffix...)
+	}
+	if n == 1 {
+		return []byte("0")
+	}
+	b := []byte("{}")
+	for len(b) < n {
+		b = append(b, ' ')
+	}
+	return b
+}
+
+func (g *Generator) letters(n int) []byte {
+	b := make([]byte, n)
+	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
+	for i, cache, remain := n-1, g.src.Int63(), letterIdxMax; i >= 0; {
+		if remain == 0 {
+			cache, remain = g.src.Int63(), letterIdxMax
+		}
+		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
+			b[i] = letterBytes[idx]
+			i--
+		}
+		cache >>= letterIdxBits
+		remain--
+	}
+	return b
+}
+
+// SeedString ... value of SeedHeader
+func (g *Generator) SeedString() string {
+	return strconv.FormatInt(g.Seed, 10)
+}
+
+// Checksum ... value of ChecksumHeader (hex encoded sha256 of body)
+func Checksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
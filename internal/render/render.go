@@ -0,0 +1,278 @@
+// Package render writes a response value in the format negotiated from format= parameter or Accept header.
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Format ... encoding of response body
+type Format string
+
+// formats
+const (
+	JSON   Format = "json"
+	Pretty Format = "pretty"
+	YAML   Format = "yaml"
+	Text   Format = "text"
+	HTML   Format = "html"
+)
+
+var contentTypes = map[Format]string{
+	JSON:   "application/json",
+	Pretty: "application/json",
+	YAML:   "application/yaml",
+	Text:   "text/plain; charset=utf-8",
+	HTML:   "text/html; charset=utf-8",
+}
+
+// Accept ヘッダのメディアタイプとフォーマットの対応
+var mediaTypes = map[string]Format{
+	"application/json":   JSON,
+	"application/yaml":   YAML,
+	"application/x-yaml": YAML,
+	"text/yaml":          YAML,
+	"text/x-yaml":        YAML,
+	"text/plain":         Text,
+	"text/html":          HTML,
+}
+
+// ParseFormat ... format of name (ok is false for unknown name)
+func ParseFormat(name string) (Format, bool) {
+	format := Format(strings.ToLower(name))
+	_, ok := contentTypes[format]
+	return format, ok
+}
+
+// ContentType ... Content-Type header value of format
+func (f Format) ContentType() string {
+	return contentTypes[f]
+}
+
+// Renderer ... settings shared by every response of a server
+// Refresh は HTML の自動更新間隔(秒、0 で更新しない)で、refresh= パラメータで上書きできる
+type Renderer struct {
+	Default Format
+	Title   string
+	Refresh int
+}
+
+// Negotiate ... format= parameter, then Accept header (highest q), then Default
+func (rd *Renderer) Negotiate(r *http.Request) Format {
+	if format, ok := ParseFormat(r.URL.Query().Get("format")); ok {
+		return format
+	}
+	best, bestQ := rd.Default, 0.0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		format, ok := mediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// Encode ... body and Content-Type of v in negotiated format
+func (rd *Renderer) Encode(r *http.Request, v interface{}) ([]byte, string, error) {
+	format := rd.Negotiate(r)
+	refresh := rd.Refresh
+	if n, err := strconv.Atoi(r.URL.Query().Get("refresh")); err == nil && n >= 0 {
+		refresh = n
+	}
+	body, err := Marshal(format, v, rd.Title, refresh)
+	return body, format.ContentType(), err
+}
+
+// Render ... write v with status in negotiated format
+func (rd *Renderer) Render(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	body, contentType, err := rd.Encode(r, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	return Write(w, status, contentType, body)
+}
+
+// Write ... write body with status
+// Content-Type が既にセット(nil による抑止を含む)されている場合は上書きしない
+func Write(w http.ResponseWriter, status int, contentType string, body []byte) error {
+	if _, ok := w.Header()["Content-Type"]; !ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+// Marshal ... encode v in format
+func Marshal(format Format, v interface{}, title string, refresh int) ([]byte, error) {
+	switch format {
+	case JSON:
+		b, err := json.Marshal(v)
+		return append(b, '\n'), err
+	case Pretty:
+		b, err := json.MarshalIndent(v, "", "  ")
+		return append(b, '\n'), err
+	}
+
+	// json タグに従ったキー名にするため JSON を経由して汎用の値に変換する
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case YAML:
+		return yaml.Marshal(generic)
+	case Text:
+		return textTable(flatten(generic)), nil
+	case HTML:
+		buf := &bytes.Buffer{}
+		err := htmlTemplate.Execute(buf, struct {
+			Title   string
+			Refresh int
+			Rows    []Row
+		}{title, refresh, flatten(generic)})
+		return buf.Bytes(), err
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// Row ... one leaf of flattened value
+type Row struct {
+	Key   string
+	Value string
+}
+
+func toGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return normalize(generic), nil
+}
+
+// normalize ... json.Number into int64 or float64 (UnixNano などの桁落ちを防ぐ)
+func normalize(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key := range value {
+			value[key] = normalize(value[key])
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = normalize(value[i])
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		f, _ := value.Float64()
+		return f
+	}
+	return v
+}
+
+// flatten ... leaves of v with dotted keys in sorted order
+func flatten(v interface{}) []Row {
+	rows := []Row{}
+	var walk func(prefix string, v interface{})
+	join := func(prefix, key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	walk = func(prefix string, v interface{}) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			if len(value) == 0 {
+				rows = append(rows, Row{prefix, "{}"})
+				return
+			}
+			keys := make([]string, 0, len(value))
+			for key := range value {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				walk(join(prefix, key), value[key])
+			}
+		case []interface{}:
+			if len(value) == 0 {
+				rows = append(rows, Row{prefix, "[]"})
+				return
+			}
+			for i := range value {
+				walk(join(prefix, strconv.Itoa(i)), value[i])
+			}
+		case float64:
+			rows = append(rows, Row{prefix, strconv.FormatFloat(value, 'f', -1, 64)})
+		case nil:
+			rows = append(rows, Row{prefix, "null"})
+		default:
+			rows = append(rows, Row{prefix, fmt.Sprint(value)})
+		}
+	}
+	walk("", v)
+	return rows
+}
+
+func textTable(rows []Row) []byte {
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\n", row.Key, strings.ReplaceAll(row.Value, "\n", `\n`))
+	}
+	tw.Flush()
+	return buf.Bytes()
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if gt .Refresh 0}}<meta http-equiv="refresh" content="{{.Refresh}}">
+{{end}}<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+td { border: 1px solid #ccc; padding: 2px 8px; font-family: monospace; vertical-align: top; }
+td.key { background: #f4f4f4; }
+td.value { white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{range .Rows}}<tr><td class="key">{{.Key}}</td><td class="value">{{.Value}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
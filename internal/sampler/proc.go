@@ -0,0 +1,242 @@
+package sampler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CPUStat ... cumulative cpu time of /proc/stat (in USER_HZ)
+type CPUStat struct {
+	Name      string
+	User      uint64
+	Nice      uint64
+	System    uint64
+	Idle      uint64
+	IOWait    uint64
+	IRQ       uint64
+	SoftIRQ   uint64
+	Steal     uint64
+	Guest     uint64
+	GuestNice uint64
+}
+
+// Total ... sum of all cpu time
+// guest/guest_nice は user/nice に含まれているため加算しない
+func (cs *CPUStat) Total() uint64 {
+	return cs.User + cs.Nice + cs.System + cs.Idle + cs.IOWait + cs.IRQ + cs.SoftIRQ + cs.Steal
+}
+
+// LoadAvg ... /proc/loadavg
+type LoadAvg struct {
+	Load1   float64 `json:"load1"`
+	Load5   float64 `json:"load5"`
+	Load15  float64 `json:"load15"`
+	Running int     `json:"running"`
+	Total   int     `json:"total"`
+}
+
+// MemInfo ... /proc/meminfo in bytes
+type MemInfo struct {
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	Available   uint64  `json:"available"`
+	Buffers     uint64  `json:"buffers"`
+	Cached      uint64  `json:"cached"`
+	Active      uint64  `json:"active"`
+	Inactive    uint64  `json:"inactive"`
+	SwapTotal   uint64  `json:"swaptotal"`
+	SwapFree    uint64  `json:"swapfree"`
+	SwapCached  uint64  `json:"swapcached"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"usedpercent"`
+}
+
+// NetDev ... counters of one interface in /proc/net/dev
+type NetDev struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rxbytes"`
+	RxPackets uint64 `json:"rxpackets"`
+	RxErrors  uint64 `json:"rxerrors"`
+	RxDrop    uint64 `json:"rxdrop"`
+	TxBytes   uint64 `json:"txbytes"`
+	TxPackets uint64 `json:"txpackets"`
+	TxErrors  uint64 `json:"txerrors"`
+	TxDrop    uint64 `json:"txdrop"`
+}
+
+// Process ... /proc/self/status of this process
+type Process struct {
+	RSS     uint64 `json:"rss"`
+	Threads int    `json:"threads"`
+}
+
+// ReadStat ... total ("cpu") and per-core ("cpuN") lines of /proc/stat
+func ReadStat(root string) ([]CPUStat, error) {
+	file, err := os.Open(filepath.Join(root, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stats := []CPUStat{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("unexpected format of /proc/stat: %s", scanner.Text())
+		}
+		values := make([]uint64, 10)
+		for i := 1; i < len(fields) && i <= len(values); i++ {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected format of /proc/stat: %s", scanner.Text())
+			}
+			values[i-1] = v
+		}
+		stats = append(stats, CPUStat{
+			Name: fields[0], User: values[0], Nice: values[1], System: values[2], Idle: values[3], IOWait: values[4],
+			IRQ: values[5], SoftIRQ: values[6], Steal: values[7], Guest: values[8], GuestNice: values[9],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 || stats[0].Name != "cpu" {
+		return nil, fmt.Errorf("cpu line not found in /proc/stat")
+	}
+	return stats, nil
+}
+
+// ReadLoadAvg ... /proc/loadavg
+func ReadLoadAvg(root string) (LoadAvg, error) {
+	data, err := os.ReadFile(filepath.Join(root, "loadavg"))
+	if err != nil {
+		return LoadAvg{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return LoadAvg{}, fmt.Errorf("unexpected format of /proc/loadavg: %s", string(data))
+	}
+	la := LoadAvg{}
+	loads := []*float64{&la.Load1, &la.Load5, &la.Load15}
+	for i, load := range loads {
+		if *load, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return LoadAvg{}, fmt.Errorf("unexpected format of /proc/loadavg: %s", string(data))
+		}
+	}
+	if procs := strings.SplitN(fields[3], "/", 2); len(procs) == 2 {
+		la.Running, _ = strconv.Atoi(procs[0])
+		la.Total, _ = strconv.Atoi(procs[1])
+	}
+	return la, nil
+}
+
+// ReadMemInfo ... /proc/meminfo
+func ReadMemInfo(root string) (MemInfo, error) {
+	values, err := readKeyValues(filepath.Join(root, "meminfo"), ':')
+	if err != nil {
+		return MemInfo{}, err
+	}
+	mi := MemInfo{
+		Total:      values["MemTotal"],
+		Free:       values["MemFree"],
+		Available:  values["MemAvailable"],
+		Buffers:    values["Buffers"],
+		Cached:     values["Cached"],
+		Active:     values["Active"],
+		Inactive:   values["Inactive"],
+		SwapTotal:  values["SwapTotal"],
+		SwapFree:   values["SwapFree"],
+		SwapCached: values["SwapCached"],
+	}
+	if mi.Total == 0 {
+		return MemInfo{}, fmt.Errorf("MemTotal not found in /proc/meminfo")
+	}
+	if mi.Available <= mi.Total {
+		mi.Used = mi.Total - mi.Available
+	}
+	mi.UsedPercent = float64(mi.Used) * 100 / float64(mi.Total)
+	return mi, nil
+}
+
+// ReadVMStat ... /proc/vmstat
+func ReadVMStat(root string) (map[string]uint64, error) {
+	return readKeyValues(filepath.Join(root, "vmstat"), ' ')
+}
+
+// ReadNetDev ... /proc/net/dev
+func ReadNetDev(root string) ([]NetDev, error) {
+	file, err := os.Open(filepath.Join(root, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	devs := []NetDev{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexRune(line, ':')
+		if i < 0 {
+			continue // header lines
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("unexpected format of /proc/net/dev: %s", line)
+		}
+		v := make([]uint64, 16)
+		for j := range v {
+			if v[j], err = strconv.ParseUint(fields[j], 10, 64); err != nil {
+				return nil, fmt.Errorf("unexpected format of /proc/net/dev: %s", line)
+			}
+		}
+		devs = append(devs, NetDev{
+			Name:    strings.TrimSpace(line[:i]),
+			RxBytes: v[0], RxPackets: v[1], RxErrors: v[2], RxDrop: v[3],
+			TxBytes: v[8], TxPackets: v[9], TxErrors: v[10], TxDrop: v[11],
+		})
+	}
+	return devs, scanner.Err()
+}
+
+// ReadProcess ... VmRSS and Threads of /proc/<pid>/status
+func ReadProcess(root, pid string) (Process, error) {
+	values, err := readKeyValues(filepath.Join(root, pid, "status"), ':')
+	if err != nil {
+		return Process{}, err
+	}
+	return Process{RSS: values["VmRSS"], Threads: int(values["Threads"])}, nil
+}
+
+// readKeyValues ... "Key: 123 kB" (or "key 123") lines, values with kB suffix are converted to bytes
+func readKeyValues(path string, sep rune) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexRune(line, sep)
+		if i < 0 {
+			continue
+		}
+		val := strings.TrimSpace(line[i+1:])
+		unit := uint64(1)
+		if strings.HasSuffix(val, "kB") {
+			val = strings.TrimSpace(strings.TrimSuffix(val, "kB"))
+			unit = 1024
+		}
+		if v, err := strconv.ParseUint(val, 10, 64); err == nil {
+			values[line[:i]] = v * unit
+		}
+	}
+	return values, scanner.Err()
+}
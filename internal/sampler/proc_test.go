@@ -0,0 +1,201 @@
+package sampler
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testdata/proc ... 正常なファイル, testdata/truncated ... 途中で切れたファイル, testdata/malformed ... 数値でない値を含むファイル
+const (
+	procRoot      = "testdata/proc"
+	truncatedRoot = "testdata/truncated"
+	malformedRoot = "testdata/malformed"
+	missingRoot   = "testdata/missing"
+)
+
+func TestReadStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    []CPUStat
+		wantErr bool
+	}{
+		{"proc", procRoot, []CPUStat{
+			{Name: "cpu", User: 4705, Nice: 150, System: 1120, Idle: 16250, IOWait: 520, SoftIRQ: 30, Steal: 10},
+			{Name: "cpu0", User: 2300, Nice: 70, System: 600, Idle: 8100, IOWait: 260, SoftIRQ: 20, Steal: 5},
+			{Name: "cpu1", User: 2405, Nice: 80, System: 520, Idle: 8150, IOWait: 260, SoftIRQ: 10, Steal: 5},
+		}, false},
+		{"truncated", truncatedRoot, nil, true},
+		{"malformed", malformedRoot, nil, true},
+		{"missing", missingRoot, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadStat(tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadStat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadStat() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadStatWithoutTotal(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "stat"), []byte("cpu0 1 2 3 4 5\nintr 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadStat(root); err == nil {
+		t.Error("ReadStat() should fail without cpu line")
+	}
+}
+
+func TestCPUStatTotal(t *testing.T) {
+	cs := CPUStat{User: 1, Nice: 2, System: 3, Idle: 4, IOWait: 5, IRQ: 6, SoftIRQ: 7, Steal: 8, Guest: 100, GuestNice: 100}
+	// guest/guest_nice は user/nice に含まれるので加算されない
+	if got := cs.Total(); got != 36 {
+		t.Errorf("Total() = %d, want 36", got)
+	}
+}
+
+func TestReadLoadAvg(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    LoadAvg
+		wantErr bool
+	}{
+		{"proc", procRoot, LoadAvg{Load1: 0.52, Load5: 0.41, Load15: 0.30, Running: 2, Total: 345}, false},
+		{"truncated", truncatedRoot, LoadAvg{}, true},
+		{"malformed", malformedRoot, LoadAvg{}, true},
+		{"missing", missingRoot, LoadAvg{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadLoadAvg(tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadLoadAvg() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadLoadAvg() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMemInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    MemInfo
+		wantErr bool
+	}{
+		{"proc", procRoot, MemInfo{
+			Total: 8000000 * 1024, Free: 2000000 * 1024, Available: 6000000 * 1024, Buffers: 100000 * 1024,
+			Cached: 3000000 * 1024, Active: 2500000 * 1024, Inactive: 2000000 * 1024,
+			SwapTotal: 1000000 * 1024, SwapFree: 900000 * 1024,
+			Used: 2000000 * 1024, UsedPercent: 25,
+		}, false},
+		// MemTotal がなければ使用率を計算できない
+		{"truncated", truncatedRoot, MemInfo{}, true},
+		// 数値でない行と区切りのない行は読み飛ばす
+		{"malformed", malformedRoot, MemInfo{
+			Total: 8000000 * 1024, Available: 6000000 * 1024, Used: 2000000 * 1024, UsedPercent: 25,
+		}, false},
+		{"missing", missingRoot, MemInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadMemInfo(tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadMemInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadMemInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadVMStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    map[string]uint64
+		wantErr bool
+	}{
+		{"proc", procRoot, map[string]uint64{"nr_free_pages": 500000, "nr_inactive_file": 250000, "pgfault": 123456789, "pgmajfault": 42}, false},
+		{"truncated", truncatedRoot, map[string]uint64{"nr_free_pages": 500000}, false},
+		{"malformed", malformedRoot, map[string]uint64{"nr_free_pages": 500000}, false},
+		{"missing", missingRoot, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadVMStat(tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadVMStat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadVMStat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadNetDev(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    []NetDev
+		wantErr bool
+	}{
+		{"proc", procRoot, []NetDev{
+			{Name: "lo", RxBytes: 12345, RxPackets: 100, TxBytes: 12345, TxPackets: 100},
+			{Name: "eth0", RxBytes: 987654321, RxPackets: 654321, RxErrors: 1, RxDrop: 2, TxBytes: 123456789, TxPackets: 123456, TxErrors: 3, TxDrop: 4},
+		}, false},
+		{"truncated", truncatedRoot, nil, true},
+		{"malformed", malformedRoot, nil, true},
+		{"missing", missingRoot, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadNetDev(tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadNetDev() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadNetDev() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    Process
+		wantErr bool
+	}{
+		{"proc", procRoot, Process{RSS: 20480 * 1024, Threads: 12}, false},
+		// 単位の前で切れた値はそのまま bytes として扱われる
+		{"truncated", truncatedRoot, Process{RSS: 20}, false},
+		{"malformed", malformedRoot, Process{RSS: 20480 * 1024}, false},
+		{"missing", missingRoot, Process{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadProcess(tt.root, "self")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadProcess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadProcess() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+// Package sampler reads /proc periodically and serves the latest snapshot without locking.
+package sampler
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/cgroup"
+)
+
+// DefaultRoot ... mount point of procfs
+const DefaultRoot = "/proc"
+
+// CPUUsage ... cpu usage (percent) between two samples
+type CPUUsage struct {
+	Name   string  `json:"name"`
+	Usage  float64 `json:"usage"`
+	User   float64 `json:"user"`
+	System float64 `json:"system"`
+	IOWait float64 `json:"iowait"`
+	Steal  float64 `json:"steal"`
+	Idle   float64 `json:"idle"`
+}
+
+// Snapshot ... os resources at a point in time
+type Snapshot struct {
+	Time      time.Time         `json:"time"`
+	CPU       CPUUsage          `json:"cpu"`
+	Cores     []CPUUsage        `json:"cores"`
+	LoadAvg   LoadAvg           `json:"loadavg"`
+	Memory    MemInfo           `json:"memory"`
+	VMStat    map[string]uint64 `json:"-"`
+	Net       []NetDev          `json:"net"`
+	Process   Process           `json:"process"`
+	Container *ContainerUsage   `json:"container,omitempty"`
+	Errors    []string          `json:"errors,omitempty"`
+}
+
+// ContainerUsage ... cpu and memory usage of the cgroup this process belongs to
+// CPU は quota (制限なしの場合はオンライン CPU 数) に対する割合
+// MemoryPercent は limit (制限なしの場合はホストの MemTotal) に対する割合
+type ContainerUsage struct {
+	Version       int     `json:"version"`
+	CPU           float64 `json:"cpu"`
+	CPUQuota      float64 `json:"cpuquota"`
+	Memory        uint64  `json:"memory"`
+	MemoryLimit   uint64  `json:"memorylimit"`
+	MemoryPercent float64 `json:"memorypercent"`
+}
+
+// Option ... settings of Sampler
+// Cgroup=true の場合は CgroupRoot (空なら /sys/fs/cgroup) から cgroup の使用量も読む
+type Option struct {
+	Root       string
+	Interval   time.Duration
+	Cgroup     bool
+	CgroupRoot string
+}
+
+// Sampler ... reads /proc on a single ticker
+type Sampler struct {
+	root     string
+	interval time.Duration
+	prev     []CPUStat
+	cgroup   *cgroup.Reader
+	prevCg   *cgroup.Stats
+	prevCgAt time.Time
+	snapshot atomic.Value
+	stop     chan struct{}
+}
+
+// New ... Sampler with an empty snapshot (call Start or Sample to fill it)
+func New(opt Option) *Sampler {
+	if opt.Root == "" {
+		opt.Root = DefaultRoot
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = 500 * time.Millisecond
+	}
+	s := &Sampler{root: opt.Root, interval: opt.Interval, stop: make(chan struct{})}
+	if opt.Cgroup {
+		s.cgroup = cgroup.New(cgroup.Option{Root: opt.CgroupRoot, ProcRoot: opt.Root})
+	}
+	s.snapshot.Store(&Snapshot{})
+	return s
+}
+
+// Start ... sample immediately and then on every interval
+func (s *Sampler) Start() {
+	s.Sample()
+	go func() {
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.Sample()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// CgroupVersion ... detected cgroup version (0: disabled or not available)
+func (s *Sampler) CgroupVersion() int {
+	if s.cgroup == nil {
+		return 0
+	}
+	return int(s.cgroup.Version)
+}
+
+// Stop ... stop the ticker started by Start
+func (s *Sampler) Stop() {
+	close(s.stop)
+}
+
+// Snapshot ... latest snapshot (must not be modified)
+func (s *Sampler) Snapshot() *Snapshot {
+	return s.snapshot.Load().(*Snapshot)
+}
+
+// Sample ... read /proc once and store new snapshot
+// cpu usage is calculated from the previous sample, so the first sample reports zero
+// Start 以外から呼ぶ場合は同時に複数の goroutine から呼ばないこと
+func (s *Sampler) Sample() *Snapshot {
+	snap := &Snapshot{Time: time.Now()}
+	addErr := func(err error) {
+		snap.Errors = append(snap.Errors, err.Error())
+	}
+
+	stats, err := ReadStat(s.root)
+	if err != nil {
+		addErr(err)
+	} else {
+		if len(s.prev) == len(stats) {
+			snap.CPU = calcUsage(&s.prev[0], &stats[0])
+			for i := 1; i < len(stats); i++ {
+				snap.Cores = append(snap.Cores, calcUsage(&s.prev[i], &stats[i]))
+			}
+		} else {
+			// 初回またはオンライン CPU 数が変わった場合は差分を計算できない
+			prev := s.Snapshot()
+			snap.CPU, snap.Cores = prev.CPU, prev.Cores
+		}
+		s.prev = stats
+	}
+	if snap.LoadAvg, err = ReadLoadAvg(s.root); err != nil {
+		addErr(err)
+	}
+	if snap.Memory, err = ReadMemInfo(s.root); err != nil {
+		addErr(err)
+	}
+	if snap.VMStat, err = ReadVMStat(s.root); err != nil {
+		addErr(err)
+	}
+	if snap.Net, err = ReadNetDev(s.root); err != nil {
+		addErr(err)
+	}
+	if snap.Process, err = ReadProcess(s.root, "self"); err != nil {
+		addErr(err)
+	}
+	if s.cgroup != nil && s.cgroup.Version != cgroup.None {
+		if snap.Container, err = s.sampleCgroup(snap); err != nil {
+			addErr(err)
+		}
+	}
+	s.snapshot.Store(snap)
+	return snap
+}
+
+// sampleCgroup ... container usage from the previous cgroup sample
+func (s *Sampler) sampleCgroup(snap *Snapshot) (*ContainerUsage, error) {
+	stats, err := s.cgroup.Read()
+	if err != nil {
+		return nil, err
+	}
+	usage := &ContainerUsage{
+		Version:     int(s.cgroup.Version),
+		CPUQuota:    stats.CPUQuota,
+		Memory:      stats.MemoryUsage,
+		MemoryLimit: stats.MemoryLimit,
+	}
+	cores := stats.CPUQuota
+	if cores <= 0 {
+		cores = float64(len(snap.Cores))
+		if cores == 0 {
+			cores = float64(runtime.NumCPU())
+		}
+	}
+	if s.prevCg != nil && stats.CPUUsage >= s.prevCg.CPUUsage {
+		elapsed := float64(snap.Time.Sub(s.prevCgAt).Microseconds())
+		if elapsed > 0 {
+			usage.CPU = float64(stats.CPUUsage-s.prevCg.CPUUsage) * 100 / (elapsed * cores)
+		}
+	}
+	limit := stats.MemoryLimit
+	if limit == 0 || (snap.Memory.Total != 0 && limit > snap.Memory.Total) {
+		limit = snap.Memory.Total
+	}
+	if limit > 0 {
+		usage.MemoryPercent = float64(stats.MemoryUsage) * 100 / float64(limit)
+	}
+	s.prevCg, s.prevCgAt = &stats, snap.Time
+	return usage, nil
+}
+
+func calcUsage(prev, cur *CPUStat) CPUUsage {
+	usage := CPUUsage{Name: cur.Name}
+	total := float64(cur.Total()) - float64(prev.Total())
+	if total <= 0 {
+		return usage
+	}
+	percent := func(p, c uint64) float64 {
+		if c < p {
+			return 0
+		}
+		return float64(c-p) * 100 / total
+	}
+	usage.User = percent(prev.User+prev.Nice, cur.User+cur.Nice)
+	usage.System = percent(prev.System+prev.IRQ+prev.SoftIRQ, cur.System+cur.IRQ+cur.SoftIRQ)
+	usage.IOWait = percent(prev.IOWait, cur.IOWait)
+	usage.Steal = percent(prev.Steal, cur.Steal)
+	usage.Idle = percent(prev.Idle, cur.Idle)
+	usage.Usage = 100 - usage.Idle - usage.IOWait
+	if usage.Usage < 0 {
+		usage.Usage = 0
+	}
+	return usage
+}
+
+// String ... one line summary
+func (snap *Snapshot) String() string {
+	if c := snap.Container; c != nil {
+		return fmt.Sprintf("cpu %6.2f%% (iowait %5.2f%% steal %5.2f%%) load %.2f mem %6.2f%% rss %d threads %d container cpu %6.2f%% mem %6.2f%%",
+			snap.CPU.Usage, snap.CPU.IOWait, snap.CPU.Steal, snap.LoadAvg.Load1, snap.Memory.UsedPercent, snap.Process.RSS, snap.Process.Threads, c.CPU, c.MemoryPercent)
+	}
+	return fmt.Sprintf("cpu %6.2f%% (iowait %5.2f%% steal %5.2f%%) load %.2f mem %6.2f%% rss %d threads %d",
+		snap.CPU.Usage, snap.CPU.IOWait, snap.CPU.Steal, snap.LoadAvg.Load1, snap.Memory.UsedPercent, snap.Process.RSS, snap.Process.Threads)
+}
@@ -0,0 +1,131 @@
+package sampler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCalcUsage(t *testing.T) {
+	prev := CPUStat{Name: "cpu", User: 1000, Nice: 100, System: 500, Idle: 8000, IOWait: 100, IRQ: 10, SoftIRQ: 40, Steal: 0}
+	tests := []struct {
+		name string
+		cur  CPUStat
+		want CPUUsage
+	}{
+		{
+			"busy",
+			// user+nice 200, system+irq+softirq 100, iowait 50, steal 50, idle 600 (total 1000)
+			CPUStat{Name: "cpu", User: 1150, Nice: 150, System: 580, Idle: 8600, IOWait: 150, IRQ: 20, SoftIRQ: 50, Steal: 50},
+			CPUUsage{Name: "cpu", Usage: 35, User: 20, System: 10, IOWait: 5, Steal: 5, Idle: 60},
+		},
+		{
+			"idle",
+			CPUStat{Name: "cpu", User: 1000, Nice: 100, System: 500, Idle: 9000, IOWait: 100, IRQ: 10, SoftIRQ: 40},
+			CPUUsage{Name: "cpu", Usage: 0, Idle: 100},
+		},
+		{
+			// カウンタが進んでいない場合は計算できない
+			"no progress",
+			prev,
+			CPUUsage{Name: "cpu"},
+		},
+		{
+			// カウンタが巻き戻った場合 (CPU のオフライン化など)
+			"counter reset",
+			CPUStat{Name: "cpu", User: 10, Nice: 0, System: 5, Idle: 80, IOWait: 1},
+			CPUUsage{Name: "cpu"},
+		},
+		{
+			// 一部のカウンタだけ巻き戻った場合はその項目を 0 とする (iowait -50, total 400)
+			"partial reset",
+			CPUStat{Name: "cpu", User: 1100, Nice: 100, System: 500, Idle: 8350, IOWait: 50, IRQ: 10, SoftIRQ: 40},
+			CPUUsage{Name: "cpu", Usage: 12.5, User: 25, Idle: 87.5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calcUsage(&prev, &tt.cur); got != tt.want {
+				t.Errorf("calcUsage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// copyProc ... copy testdata/proc to a temporary root which can be rewritten between samples
+func copyProc(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	err := filepath.Walk(procRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(procRoot, path)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(root, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(root, rel), data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func writeStat(t *testing.T, root, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(root, "stat"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSample(t *testing.T) {
+	root := copyProc(t)
+	s := New(Option{Root: root})
+
+	first := s.Sample()
+	if len(first.Errors) != 0 {
+		t.Fatalf("Sample() errors = %v", first.Errors)
+	}
+	// 初回は差分がないので 0
+	if first.CPU.Usage != 0 || len(first.Cores) != 0 {
+		t.Errorf("first sample cpu = %+v, cores = %+v, want zero", first.CPU, first.Cores)
+	}
+	if first.Memory.UsedPercent != 25 || first.LoadAvg.Running != 2 || first.Process.Threads != 12 || len(first.Net) != 2 {
+		t.Errorf("first sample = %+v", first)
+	}
+
+	// cpu0 は 50%, cpu1 は 0% (各 200 tick 経過)
+	writeStat(t, root, "cpu  4805 150 1120 16550 520 0 30 10 0 0\n"+
+		"cpu0 2400 70 600 8200 260 0 20 5 0 0\n"+
+		"cpu1 2405 80 520 8350 260 0 10 5 0 0\n")
+	second := s.Sample()
+	if second.CPU.Usage != 25 || second.CPU.User != 25 {
+		t.Errorf("second sample cpu = %+v, want 25%%", second.CPU)
+	}
+	if len(second.Cores) != 2 || second.Cores[0].Usage != 50 || second.Cores[1].Usage != 0 {
+		t.Errorf("second sample cores = %+v, want 50%% and 0%%", second.Cores)
+	}
+	if s.Snapshot() != second {
+		t.Error("Snapshot() should return the latest sample")
+	}
+
+	// CPU 数が変わった場合は前回の値を引き継ぐ
+	writeStat(t, root, "cpu  4905 150 1120 16850 520 0 30 10 0 0\ncpu0 2500 70 600 8500 260 0 20 5 0 0\n")
+	third := s.Sample()
+	if third.CPU != second.CPU || len(third.Cores) != 2 {
+		t.Errorf("third sample cpu = %+v, cores = %+v, want previous values", third.CPU, third.Cores)
+	}
+
+	// 読めないファイルがあっても他の値は更新される
+	writeStat(t, root, "cpu  1 2\n")
+	fourth := s.Sample()
+	if len(fourth.Errors) != 1 || fourth.Memory.UsedPercent != 25 {
+		t.Errorf("fourth sample errors = %v, memory = %+v", fourth.Errors, fourth.Memory)
+	}
+}
@@ -1,46 +1,27 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"log"
-	"os"
-	"strconv"
-	"strings"
 	"time"
+
+	"github.com/miyaz/go-examples/internal/sampler"
 )
 
 func main() {
 	fmt.Println("CPU usage % at 1 second intervals:")
-	var prevIdleTime, prevTotalTime uint64
+	s := sampler.New(sampler.Option{})
 
 	for i := 0; ; i++ {
-		file, err := os.Open("/proc/stat")
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Scan()
-		firstLine := scanner.Text()[5:] // get rid of cpu plus 2 spaces
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
-		split := strings.Fields(firstLine)
-		idleTime, _ := strconv.ParseUint(split[3], 10, 64)
-		totalTime := uint64(0)
-		for _, s := range split {
-			u, _ := strconv.ParseUint(s, 10, 64)
-			totalTime += u
-		}
+		snap := s.Sample()
 		if i > 0 {
-			deltaIdleTime := idleTime - prevIdleTime
-			deltaTotalTime := totalTime - prevTotalTime
-			cpuUsage := (1.0 - float64(deltaIdleTime)/float64(deltaTotalTime)) * 100.0
-			fmt.Printf("%d : %6.3f\n", i, cpuUsage)
+			fmt.Printf("%d : %6.3f (iowait %6.3f steal %6.3f)\n", i, snap.CPU.Usage, snap.CPU.IOWait, snap.CPU.Steal)
+			for _, core := range snap.Cores {
+				fmt.Printf("    %-6s: %6.3f\n", core.Name, core.Usage)
+			}
+		}
+		for _, err := range snap.Errors {
+			fmt.Println(err)
 		}
-		prevIdleTime = idleTime
-		prevTotalTime = totalTime
 		time.Sleep(time.Second)
 	}
 }
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
 	"os"
-	"sort"
+	"strings"
 
+	"github.com/miyaz/go-examples/internal/netaddr"
+	"github.com/miyaz/go-examples/internal/render"
 	"github.com/sirupsen/logrus"
 )
 
@@ -13,8 +14,16 @@ var (
 	revision string
 	buildAt  string
 	logger   *logrus.Logger
+	renderer = &render.Renderer{Default: render.Text, Title: "httpserver", Refresh: 2}
 )
 
+// ResponseInfo ... information of response
+type ResponseInfo struct {
+	Host   string            `json:"host"`
+	IP     string            `json:"ip"`
+	Header map[string]string `json:"header"`
+}
+
 func init() {
 	logger = &logrus.Logger{
 		Out:       os.Stdout,
@@ -38,31 +47,24 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 	logger := logger.WithFields(logrus.Fields{"host": host, "ip": ip})
 	logger.Debugf("%s %s?%s %s", r.Method, r.URL.Path, r.URL.RawQuery, r.Proto)
-	fmt.Fprint(w, fmt.Sprintf("host: %s\nip: %s\n\n", host, ip))
-
-	headers := headerToArray(r.Header)
-	sort.Strings(headers)
-	for _, header := range headers {
-		fmt.Fprint(w, header+"\n")
-	}
+	renderer.Render(w, r, http.StatusOK, ResponseInfo{host, ip, combineValues(r.Header)})
 }
 
+// readUserIP ... client address from X-Real-Ip, first entry of X-Forwarded-For or RemoteAddr
 func readUserIP(r *http.Request) string {
-	IPAddress := r.Header.Get("X-Real-Ip")
-	if IPAddress == "" {
-		IPAddress = r.Header.Get("X-Forwarded-For")
+	if IPAddress := r.Header.Get("X-Real-Ip"); IPAddress != "" {
+		return netaddr.Host(IPAddress)
 	}
-	if IPAddress == "" {
-		IPAddress = r.RemoteAddr
+	if xff := netaddr.SplitXFF(r.Header.Values("X-Forwarded-For")...); len(xff) > 0 {
+		return xff[0]
 	}
-	return IPAddress
+	return netaddr.Host(r.RemoteAddr)
 }
 
-func headerToArray(header http.Header) (res []string) {
+func combineValues(header http.Header) map[string]string {
+	output := map[string]string{}
 	for name, values := range header {
-		for _, value := range values {
-			res = append(res, fmt.Sprintf("%s: %s", name, value))
-		}
+		output[name] = strings.Join(values, ", ")
 	}
-	return
+	return output
 }
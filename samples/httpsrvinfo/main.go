@@ -1,15 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"sort"
-	"strings"
 	"sync"
+
+	"github.com/miyaz/go-examples/internal/netaddr"
+	"github.com/miyaz/go-examples/internal/render"
 )
 
 // DataStore ... Variables that use mutex
@@ -22,9 +22,10 @@ type DataStore struct {
 
 // ServerInfo ... information of server
 type ServerInfo struct {
-	Name string
-	IP   string
-	AZ   string
+	Name      string            `json:"name"`
+	IP        string            `json:"ip"`
+	AZ        string            `json:"az,omitempty"`
+	Addresses []netaddr.Address `json:"addresses,omitempty"`
 }
 
 // ResourceData ... OS Resource Data
@@ -59,30 +60,39 @@ type HandleInfo struct {
 	ClientIP     string `json:"clientip"`
 }
 
+// ResponseInfo ... information of response
+type ResponseInfo struct {
+	Handle      HandleInfo        `json:"handle"`
+	Host        string            `json:"host"`
+	RemoteAddr  string            `json:"remoteaddr"`
+	Server      ServerInfo        `json:"server"`
+	Path        string            `json:"path"`
+	Query       string            `json:"querystring"`
+	XFF         []string          `json:"xff"`
+	Header      map[string]string `json:"header"`
+	QueryString map[string]string `json:"query"`
+	Resource    ResourceData      `json:"resource"`
+}
+
 var store = &DataStore{&sync.RWMutex{}, ServerInfo{}, ResourceData{}, ResourceData{}}
+var renderer = &render.Renderer{Default: render.Text, Title: "httpsrvinfo", Refresh: 2}
 
-func getIPAddress() string {
-	var currentIP string
-	addrs, err := net.InterfaceAddrs()
+func getIPAddresses() []netaddr.Address {
+	addrs, err := netaddr.Interfaces()
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				fmt.Println("Current IP address : ", ipnet.IP.String())
-				currentIP = ipnet.IP.String()
-			}
-		}
+	for _, addr := range addrs {
+		fmt.Printf("IP address : %s/%d (%s, %s, %s)\n", addr.IP, addr.Prefix, addr.Interface, addr.Family, addr.Scope)
 	}
-	return currentIP
+	return addrs
 }
 
 func main() {
 	store.Lock()
 	store.server.Name, _ = os.Hostname()
-	store.server.IP = getIPAddress()
+	store.server.Addresses = getIPAddresses()
+	store.server.IP = netaddr.Primary(store.server.Addresses, netaddr.IPv4)
 	store.Unlock()
 	http.HandleFunc("/", handler)
 	srv := &http.Server{Addr: ":9000"}
@@ -93,35 +103,29 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	//qs := &QueryString{}
 	hi := &HandleInfo{}
 	setHandleInfo(hi, r)
-	hiJSON, err := json.Marshal(hi)
-	if err != nil {
-		log.Fatalln(err)
+	store.RLock()
+	respInfo := ResponseInfo{
+		Handle:      *hi,
+		Host:        r.Host,
+		RemoteAddr:  r.RemoteAddr,
+		Server:      store.server,
+		Path:        r.URL.EscapedPath(),
+		Query:       r.URL.Query().Encode(),
+		XFF:         netaddr.SplitXFF(r.Header.Values("X-Forwarded-For")...),
+		Header:      joinkeyValues(r.Header),
+		QueryString: joinkeyValues(r.URL.Query()),
+		Resource:    store.current,
 	}
-	fmt.Fprintf(w, string(hiJSON))
-
-	fmt.Fprintf(w, "host: %s\nremoteaddr: %s\n", r.Host, r.RemoteAddr)
-	fmt.Fprintf(w, "hostname: %s\nserverip: %s\n\n", store.server.Name, store.server.IP)
-	fmt.Fprintf(w, "path: %s\nquerystring: %s\n", r.URL.EscapedPath(), r.URL.Query().Encode())
-
-	fmt.Fprintf(w, "XFF: %v\n", splitXFF(r.Header.Get("X-Forwarded-For")))
-
-	fmt.Fprintf(w, "[Headers]\n")
-	for _, kv := range sortkeyValues(r.Header) {
-		fmt.Fprintf(w, "%s = %s\n", kv.key, kv.value)
-	}
-	fmt.Fprintf(w, "[QueryString]\n")
-	for _, kv := range sortkeyValues(r.URL.Query()) {
-		fmt.Fprintf(w, "%s = %s\n", kv.key, kv.value)
-	}
-	fmt.Fprintf(w, "%v %v", store.server, store.current)
+	store.RUnlock()
+	renderer.Render(w, r, http.StatusOK, respInfo)
 }
 
 func setHandleInfo(hi *HandleInfo, r *http.Request) {
 	hi.TargetIP = store.server.IP
-	hi.ServerIP = strings.Split(r.Host, ":")[0]
-	xff := splitXFF(r.Header.Get("X-Forwarded-For"))
+	hi.ServerIP = netaddr.Host(r.Host)
+	xff := netaddr.SplitXFF(r.Header.Values("X-Forwarded-For")...)
 	if len(xff) == 0 {
-		hi.ClientIP = strings.Split(r.RemoteAddr, ":")[0]
+		hi.ClientIP = netaddr.Host(r.RemoteAddr)
 	} else {
 		hi.ClientIP = xff[0]
 	}
@@ -133,12 +137,17 @@ func setHandleInfo(hi *HandleInfo, r *http.Request) {
 	}
 }
 
-func splitXFF(xffStr string) []string {
-	xff := strings.Split(xffStr, ",")
-	for i := range xff {
-		xff[i] = strings.TrimSpace(xff[i])
+// joinkeyValues ... sorted values of each key joined with ", "
+func joinkeyValues(input map[string][]string) map[string]string {
+	output := map[string]string{}
+	for _, kv := range sortkeyValues(input) {
+		if value, ok := output[kv.key]; ok {
+			output[kv.key] = value + ", " + kv.value
+		} else {
+			output[kv.key] = kv.value
+		}
 	}
-	return xff
+	return output
 }
 
 type keyValue struct {
@@ -2,45 +2,74 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"log"
-	"math/rand"
 	"net/http"
 	"strconv"
-	"time"
+
+	"github.com/miyaz/go-examples/internal/payload"
 )
 
 const (
-	letterBytes   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-	respSize      = 102400
+	respSize = 102400
 )
 
+// size= の上限(超える値は切り詰める)
+var maxSize int
+
 func main() {
+	flag.IntVar(&maxSize, "max-size", 10<<20, "max bytes of size= (larger values are clamped)")
+	flag.Parse()
 	http.HandleFunc("/", handler)
 	srv := &http.Server{Addr: ":9000"}
 	log.Fatalln(srv.ListenAndServe())
 
 }
 
+// handler ... stream payload of size= bytes (mode は payload=、seed= を指定すると同じ内容を再現できる)
 func handler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s %s?%s %s", r.Method, r.URL.Path, r.URL.RawQuery, r.Proto)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Length", strconv.Itoa(respSize))
+	query := r.URL.Query()
+	size := respSize
+	if n, err := strconv.Atoi(query.Get("size")); err == nil && n >= 0 {
+		size = n
+	}
+	if size > maxSize {
+		size = maxSize
+	}
+	mode, ok := payload.ParseMode(query.Get("payload"))
+	if !ok {
+		mode = payload.Text
+	}
+	seed, _ := strconv.ParseInt(query.Get("seed"), 10, 64)
+	gen := payload.New(payload.Option{Mode: mode, Seed: seed, Pattern: query.Get("pattern")})
+
+	var body []byte
+	if mode == payload.Text {
+		// 100 bytes ごとに改行を入れる
+		body = make([]byte, 0, size)
+		for len(body)+100 <= size {
+			body = append(body, gen.Generate(99)...)
+			body = append(body, '\n')
+		}
+		body = append(body, gen.Generate(size-len(body))...)
+	} else {
+		body = gen.Generate(size)
+	}
+
+	w.Header().Set("Content-Type", mode.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set(payload.SeedHeader, gen.SeedString())
+	w.Header().Set(payload.ChecksumHeader, payload.Checksum(body))
 
 	//fmt.Fprint(w, host+"\n")
 	fw := bufio.NewWriter(w)
-	src := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	loopCount := respSize / 100
-	remainder := respSize % 100
-	for i := 0; i < loopCount; i++ {
-		fw.Write(randBytes(src, 99))
-		fw.Write([]byte("\n"))
-	}
-	if remainder != 0 {
-		fw.Write(randBytes(src, remainder))
+	for i := 0; i < len(body); i += 100 {
+		end := i + 100
+		if end > len(body) {
+			end = len(body)
+		}
+		fw.Write(body[i:end])
 	}
 
 	err := fw.Flush()
@@ -48,21 +77,3 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		log.Fatalln(err)
 	}
 }
-
-func randBytes(src *rand.Rand, n int) []byte {
-	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-
-	return b
-}
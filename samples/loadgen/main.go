@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Option ... settings of load generator
+type Option struct {
+	URL         string
+	Query       string
+	Requests    int
+	Duration    time.Duration
+	Rate        float64
+	Concurrency int
+	KeepAlive   bool
+	HTTP2       bool
+	Insecure    bool
+	Timeout     time.Duration
+	Format      string
+	Output      string
+}
+
+// ResponseInfo ... subset of backend response (samples/reqhandle)
+type ResponseInfo struct {
+	Host struct {
+		Name string `json:"name"`
+		IP   string `json:"ip"`
+		AZ   string `json:"az"`
+	} `json:"host"`
+	Direction struct {
+		Action map[string]string `json:"action"`
+	} `json:"direction"`
+}
+
+// Result ... result of one request
+type Result struct {
+	Status  int
+	Latency time.Duration
+	Target  string
+	AZ      string
+	Actions []string
+	Err     error
+}
+
+// Counter ... count with ratio
+type Counter struct {
+	Key     string  `json:"key"`
+	Count   int64   `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// Latency ... latency percentiles in milliseconds
+type Latency struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Report ... summary of all results
+type Report struct {
+	URL      string    `json:"url"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	Elapsed  float64   `json:"elapsed"`
+	RPS      float64   `json:"rps"`
+	Latency  Latency   `json:"latency"`
+	Targets  []Counter `json:"targets"`
+	AZs      []Counter `json:"azs"`
+	Statuses []Counter `json:"statuses"`
+	Actions  []Counter `json:"actions"`
+}
+
+// 1 リクエストあたりの間隔が time.Ticker で扱える範囲に収まる上限
+const maxRate = 1e6
+
+// -n と -duration のどちらも指定しない場合のリクエスト数
+const defaultRequests = 100
+
+// report formats
+var formats = map[string]bool{"text": true, "json": true, "csv": true}
+
+// TemplateData ... values available in query template
+type TemplateData struct {
+	Seq    int
+	Worker int
+}
+
+var option = &Option{}
+
+func main() {
+	flag.StringVar(&option.URL, "url", "http://localhost:9000/", "target url (ELB endpoint)")
+	flag.StringVar(&option.Query, "query", "", `query string template (e.g. "sleep={{rand 100 500}}&seq={{.Seq}}")`)
+	flag.IntVar(&option.Requests, "n", 0, fmt.Sprintf("number of requests (0: until -duration, %d without -duration)", defaultRequests))
+	flag.DurationVar(&option.Duration, "duration", 0, "duration of test (0: until -n)")
+	flag.Float64Var(&option.Rate, "rate", 0, "requests per second (0: as fast as possible)")
+	flag.IntVar(&option.Concurrency, "c", 1, "number of concurrent workers")
+	flag.BoolVar(&option.KeepAlive, "keepalive", true, "reuse connections (HTTP/1.1 keep-alive)")
+	flag.BoolVar(&option.HTTP2, "http2", false, "use HTTP/2 (https only)")
+	flag.BoolVar(&option.Insecure, "insecure", false, "skip tls certificate verification")
+	flag.DurationVar(&option.Timeout, "timeout", 30*time.Second, "timeout of each request")
+	flag.StringVar(&option.Format, "format", "text", "report format (text|json|csv)")
+	flag.StringVar(&option.Output, "o", "", "report file (empty: stdout)")
+	flag.Parse()
+	// -duration だけを指定した場合は時間で止める
+	if option.Requests == 0 && option.Duration == 0 {
+		option.Requests = defaultRequests
+	}
+
+	if err := validateOption(option); err != nil {
+		log.Fatalln(err)
+	}
+	tmpl, err := newQueryTemplate(option.Query)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	client := newClient(option)
+	startedAt := time.Now()
+	results := run(option, client, tmpl)
+	report := summarize(option.URL, results, time.Since(startedAt))
+
+	out := io.Writer(os.Stdout)
+	if option.Output != "" {
+		f, err := os.Create(option.Output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeReport(out, option.Format, report); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// validateOption ... check options before sending any request (負荷をかけ終わってからエラーにしない)
+func validateOption(opt *Option) error {
+	if opt.Requests <= 0 && opt.Duration <= 0 {
+		return fmt.Errorf("either -n or -duration is required")
+	}
+	if opt.Concurrency < 1 {
+		opt.Concurrency = 1
+	}
+	if opt.HTTP2 && !strings.HasPrefix(opt.URL, "https://") {
+		return fmt.Errorf("-http2 requires https url")
+	}
+	if opt.Rate < 0 || maxRate < opt.Rate {
+		return fmt.Errorf("-rate must be 0-%g: %g", maxRate, opt.Rate)
+	}
+	if !formats[opt.Format] {
+		return fmt.Errorf("unknown format: %s", opt.Format)
+	}
+	return nil
+}
+
+func newQueryTemplate(query string) (*template.Template, error) {
+	return template.New("query").Funcs(template.FuncMap{
+		"rand": func(min, max int) int {
+			if max <= min {
+				return min
+			}
+			return min + rand.Intn(max-min+1)
+		},
+	}).Parse(query)
+}
+
+func newClient(opt *Option) *http.Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DisableKeepAlives:   !opt.KeepAlive,
+		MaxIdleConnsPerHost: opt.Concurrency,
+		ForceAttemptHTTP2:   opt.HTTP2,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: opt.Insecure},
+	}
+	if !opt.HTTP2 {
+		// 空でない map を設定すると HTTP/2 へのアップグレードを行わない
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opt.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// run ... send requests by workers and collect results
+func run(opt *Option, client *http.Client, tmpl *template.Template) []Result {
+	jobs := make(chan int)
+	resultCh := make(chan Result)
+	var wg sync.WaitGroup
+	for i := 0; i < opt.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for seq := range jobs {
+				resultCh <- request(client, opt.URL, tmpl, TemplateData{Seq: seq, Worker: worker})
+			}
+		}(i)
+	}
+
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if opt.Rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / opt.Rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		var deadline <-chan time.Time
+		if opt.Duration > 0 {
+			timer := time.NewTimer(opt.Duration)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		for seq := 1; opt.Requests <= 0 || seq <= opt.Requests; seq++ {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-deadline:
+					return
+				}
+			}
+			select {
+			case jobs <- seq:
+			case <-deadline:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	results := []Result{}
+	for result := range resultCh {
+		results = append(results, result)
+	}
+	return results
+}
+
+func request(client *http.Client, url string, tmpl *template.Template, data TemplateData) Result {
+	query := new(bytes.Buffer)
+	if err := tmpl.Execute(query, data); err != nil {
+		return Result{Err: err}
+	}
+	if query.Len() > 0 {
+		if strings.Contains(url, "?") {
+			url += "&" + query.String()
+		} else {
+			url += "?" + query.String()
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header.Set("Accept", "application/json")
+
+	startedAt := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{Latency: time.Since(startedAt), Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	result := Result{Status: resp.StatusCode, Latency: time.Since(startedAt), Err: err}
+
+	respInfo := ResponseInfo{}
+	if err := json.Unmarshal(body, &respInfo); err != nil {
+		result.Target = "(unknown)"
+		return result
+	}
+	result.Target = respInfo.Host.Name + " (" + respInfo.Host.IP + ")"
+	result.AZ = respInfo.Host.AZ
+	for key := range respInfo.Direction.Action {
+		result.Actions = append(result.Actions, key)
+	}
+	return result
+}
+
+func summarize(url string, results []Result, elapsed time.Duration) *Report {
+	report := &Report{URL: url, Requests: int64(len(results)), Elapsed: elapsed.Seconds()}
+	if elapsed > 0 {
+		report.RPS = float64(len(results)) / elapsed.Seconds()
+	}
+	targets := map[string]int64{}
+	azs := map[string]int64{}
+	statuses := map[string]int64{}
+	actions := map[string]int64{}
+	latencies := []float64{}
+	for _, result := range results {
+		if result.Err != nil {
+			report.Errors++
+			statuses["error"]++
+			continue
+		}
+		latencies = append(latencies, float64(result.Latency)/float64(time.Millisecond))
+		statuses[strconv.Itoa(result.Status)]++
+		targets[result.Target]++
+		if result.AZ != "" {
+			azs[result.AZ]++
+		}
+		for _, action := range result.Actions {
+			actions[action]++
+		}
+	}
+	report.Latency = calcLatency(latencies)
+	report.Targets = toCounters(targets, report.Requests)
+	report.AZs = toCounters(azs, report.Requests)
+	report.Statuses = toCounters(statuses, report.Requests)
+	report.Actions = toCounters(actions, report.Requests)
+	return report
+}
+
+func calcLatency(latencies []float64) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Float64s(latencies)
+	sum := 0.0
+	for _, l := range latencies {
+		sum += l
+	}
+	percentile := func(p float64) float64 {
+		return latencies[int(float64(len(latencies)-1)*p/100)]
+	}
+	return Latency{
+		Min: latencies[0],
+		Avg: sum / float64(len(latencies)),
+		P50: percentile(50),
+		P90: percentile(90),
+		P95: percentile(95),
+		P99: percentile(99),
+		Max: latencies[len(latencies)-1],
+	}
+}
+
+func toCounters(input map[string]int64, total int64) []Counter {
+	counters := []Counter{}
+	for key, count := range input {
+		counters = append(counters, Counter{Key: key, Count: count, Percent: float64(count) * 100 / float64(total)})
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Count != counters[j].Count {
+			return counters[i].Count > counters[j].Count
+		}
+		return counters[i].Key < counters[j].Key
+	})
+	return counters
+}
+
+func writeReport(w io.Writer, format string, report *Report) error {
+	switch format {
+	case "json":
+		s, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", string(s))
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"category", "key", "count", "percent"})
+		l := report.Latency
+		for _, kv := range []struct {
+			key   string
+			value float64
+		}{{"min", l.Min}, {"avg", l.Avg}, {"p50", l.P50}, {"p90", l.P90}, {"p95", l.P95}, {"p99", l.P99}, {"max", l.Max}} {
+			cw.Write([]string{"latency_ms", kv.key, fmt.Sprintf("%.3f", kv.value), ""})
+		}
+		for _, section := range []struct {
+			name     string
+			counters []Counter
+		}{{"target", report.Targets}, {"az", report.AZs}, {"status", report.Statuses}, {"action", report.Actions}} {
+			for _, c := range section.counters {
+				cw.Write([]string{section.name, c.Key, strconv.FormatInt(c.Count, 10), fmt.Sprintf("%.2f", c.Percent)})
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "text":
+		fmt.Fprintf(w, "url: %s\nrequests: %d  errors: %d  elapsed: %.2fs  rps: %.2f\n\n", report.URL, report.Requests, report.Errors, report.Elapsed, report.RPS)
+		l := report.Latency
+		fmt.Fprintf(w, "[Latency (ms)]\nmin %.1f  avg %.1f  p50 %.1f  p90 %.1f  p95 %.1f  p99 %.1f  max %.1f\n", l.Min, l.Avg, l.P50, l.P90, l.P95, l.P99, l.Max)
+		for _, section := range []struct {
+			name     string
+			counters []Counter
+		}{{"Targets", report.Targets}, {"AZs", report.AZs}, {"Statuses", report.Statuses}, {"Actions", report.Actions}} {
+			fmt.Fprintf(w, "\n[%s]\n", section.name)
+			for _, c := range section.counters {
+				fmt.Fprintf(w, "%-40s %8d %6.2f%%\n", c.Key, c.Count, c.Percent)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBackend ... local server which answers like samples/reqhandle behind a round robin load balancer
+func newBackend(t *testing.T) (*httptest.Server, *int64) {
+	t.Helper()
+	var count int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&count, 1)
+		target := n % 2
+		action := map[string]string{}
+		for key := range r.URL.Query() {
+			action[key] = r.URL.Query().Get(key)
+		}
+		status := http.StatusOK
+		if s, err := strconv.Atoi(r.URL.Query().Get("status")); err == nil {
+			status = s
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"host":{"name":"target%d","ip":"10.0.0.%d","az":"az-%d"},"direction":{"action":%s}}`,
+			target, target+1, target, mustJSON(t, action))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &count
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestValidateOption(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+		ok   bool
+	}{
+		{"requests", Option{URL: "http://localhost/", Requests: 1, Format: "text"}, true},
+		{"duration", Option{URL: "http://localhost/", Duration: time.Second, Format: "csv"}, true},
+		{"no requests nor duration", Option{URL: "http://localhost/", Format: "text"}, false},
+		{"unknown format", Option{URL: "http://localhost/", Requests: 1, Format: "xml"}, false},
+		{"negative rate", Option{URL: "http://localhost/", Requests: 1, Rate: -1, Format: "json"}, false},
+		{"too high rate", Option{URL: "http://localhost/", Requests: 1, Rate: 2e9, Format: "json"}, false},
+		{"max rate", Option{URL: "http://localhost/", Requests: 1, Rate: maxRate, Format: "json"}, true},
+		{"http2 without tls", Option{URL: "http://localhost/", Requests: 1, HTTP2: true, Format: "text"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := tt.opt
+			err := validateOption(&opt)
+			if (err == nil) != tt.ok {
+				t.Errorf("validateOption() error = %v, want ok = %v", err, tt.ok)
+			}
+			if err == nil && opt.Concurrency < 1 {
+				t.Errorf("concurrency = %d, want >= 1", opt.Concurrency)
+			}
+		})
+	}
+}
+
+func TestRunAgainstLocalServer(t *testing.T) {
+	srv, count := newBackend(t)
+	opt := &Option{URL: srv.URL + "/", Query: "seq={{.Seq}}&status={{if eq .Seq 1}}503{{else}}200{{end}}", Requests: 20, Concurrency: 4, KeepAlive: true, Timeout: 5 * time.Second, Format: "json"}
+	if err := validateOption(opt); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := newQueryTemplate(opt.Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := run(opt, newClient(opt), tmpl)
+	report := summarize(opt.URL, results, time.Second)
+
+	if got := atomic.LoadInt64(count); got != 20 {
+		t.Errorf("backend received %d requests, want 20", got)
+	}
+	if report.Requests != 20 || report.Errors != 0 {
+		t.Errorf("requests = %d, errors = %d, want 20, 0", report.Requests, report.Errors)
+	}
+	wantTargets := map[string]int64{"target0 (10.0.0.1)": 10, "target1 (10.0.0.2)": 10}
+	for _, c := range report.Targets {
+		if wantTargets[c.Key] != c.Count {
+			t.Errorf("target %s = %d, want %d", c.Key, c.Count, wantTargets[c.Key])
+		}
+	}
+	if len(report.Targets) != 2 || len(report.AZs) != 2 {
+		t.Errorf("targets = %v, azs = %v, want 2 of each", report.Targets, report.AZs)
+	}
+	statuses := map[string]int64{}
+	for _, c := range report.Statuses {
+		statuses[c.Key] = c.Count
+	}
+	if statuses["503"] != 1 || statuses["200"] != 19 {
+		t.Errorf("statuses = %v, want 503:1 200:19", statuses)
+	}
+	actions := map[string]int64{}
+	for _, c := range report.Actions {
+		actions[c.Key] = c.Count
+	}
+	if actions["seq"] != 20 || actions["status"] != 20 {
+		t.Errorf("actions = %v, want seq:20 status:20", actions)
+	}
+	if report.Latency.Max < report.Latency.P50 || report.Latency.P50 < report.Latency.Min {
+		t.Errorf("latency is not ordered: %+v", report.Latency)
+	}
+}
+
+// startReqhandle ... build and start samples/reqhandle on a free port
+func startReqhandle(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skip building reqhandle in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "reqhandle")
+	if out, err := exec.Command(goBin, "build", "-o", bin, "../reqhandle").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cmd := exec.Command(bin, "-port", strconv.Itoa(port), "-admin-addr", "")
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+			return url
+		}
+	}
+	t.Fatal("reqhandle did not start")
+	return ""
+}
+
+// TestRunAgainstReqhandle ... ResponseInfo が reqhandle の実際の応答と食い違っていないこと
+func TestRunAgainstReqhandle(t *testing.T) {
+	url := startReqhandle(t)
+	opt := &Option{URL: url, Query: "sleep=1", Requests: 5, Concurrency: 2, KeepAlive: true, Timeout: 5 * time.Second, Format: "json"}
+	if err := validateOption(opt); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, _ := newQueryTemplate(opt.Query)
+	report := summarize(opt.URL, run(opt, newClient(opt), tmpl), time.Second)
+
+	if report.Requests != 5 || report.Errors != 0 {
+		t.Fatalf("requests = %d, errors = %d, want 5, 0", report.Requests, report.Errors)
+	}
+	hostname, _ := os.Hostname()
+	if len(report.Targets) != 1 || !strings.HasPrefix(report.Targets[0].Key, hostname+" (") || strings.HasSuffix(report.Targets[0].Key, "()") {
+		t.Errorf("targets = %v, want host name and ip of %s", report.Targets, hostname)
+	}
+	if len(report.Actions) != 1 || report.Actions[0].Key != "sleep" || report.Actions[0].Count != 5 {
+		t.Errorf("actions = %v, want sleep:5", report.Actions)
+	}
+}
+
+func TestRunWithRate(t *testing.T) {
+	srv, _ := newBackend(t)
+	opt := &Option{URL: srv.URL + "/", Requests: 5, Rate: 50, Concurrency: 1, KeepAlive: true, Timeout: 5 * time.Second, Format: "text"}
+	if err := validateOption(opt); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, _ := newQueryTemplate(opt.Query)
+	startedAt := time.Now()
+	results := run(opt, newClient(opt), tmpl)
+	// 50 rps で 5 リクエストなら最初のティックまでを含めて 100ms 以上かかる
+	if elapsed := time.Since(startedAt); elapsed < 90*time.Millisecond {
+		t.Errorf("elapsed = %v, want >= 100ms at 50 rps", elapsed)
+	}
+	if len(results) != 5 {
+		t.Errorf("results = %d, want 5", len(results))
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	report := &Report{
+		URL:      "http://localhost/",
+		Requests: 2,
+		Targets:  []Counter{{Key: "target0 (10.0.0.1)", Count: 2, Percent: 100}},
+		Statuses: []Counter{{Key: "200", Count: 2, Percent: 100}},
+	}
+	for format := range formats {
+		buf := &bytes.Buffer{}
+		if err := writeReport(buf, format, report); err != nil {
+			t.Errorf("writeReport(%s) error = %v", format, err)
+		}
+		if buf.Len() == 0 {
+			t.Errorf("writeReport(%s) wrote nothing", format)
+		}
+		switch format {
+		case "json":
+			decoded := Report{}
+			if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || decoded.Requests != 2 {
+				t.Errorf("json report = %s, error = %v", buf.String(), err)
+			}
+		case "csv":
+			records, err := csv.NewReader(buf).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// header + latency 7 行 + target + status
+			if len(records) != 10 {
+				t.Errorf("csv records = %d, want 10", len(records))
+			}
+		}
+	}
+	if err := writeReport(&bytes.Buffer{}, "xml", report); err == nil {
+		t.Error("writeReport(xml) should fail")
+	}
+}
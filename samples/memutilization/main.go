@@ -1,23 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
-	"os"
 	"runtime"
-	"strconv"
-	"strings"
 	"time"
-)
 
-// Stats represents memory statistics for linux
-type Stats struct {
-	Total, Used, Buffers, Cached, Free, Available, Active, Inactive,
-	SwapTotal, SwapUsed, SwapCached, SwapFree uint64
-}
+	"github.com/miyaz/go-examples/internal/sampler"
+)
 
 func main() {
 	fmt.Println("Memory usage % at 1 second intervals:")
@@ -26,45 +18,10 @@ func main() {
 		if i < 20 {
 			go consumeMemory()
 		}
-		file, err := os.Open("/proc/meminfo")
+		memory, err := sampler.ReadMemInfo(sampler.DefaultRoot)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		var memory Stats
-		memStats := map[string]*uint64{
-			"MemTotal":     &memory.Total,
-			"MemFree":      &memory.Free,
-			"MemAvailable": &memory.Available,
-			"Buffers":      &memory.Buffers,
-			"Cached":       &memory.Cached,
-			"Active":       &memory.Active,
-			"Inactive":     &memory.Inactive,
-			"SwapCached":   &memory.SwapCached,
-			"SwapTotal":    &memory.SwapTotal,
-			"SwapFree":     &memory.SwapFree,
-		}
-		for scanner.Scan() {
-			line := scanner.Text()
-			i := strings.IndexRune(line, ':')
-			if i < 0 {
-				continue
-			}
-			fld := line[:i]
-			if ptr := memStats[fld]; ptr != nil {
-				val := strings.TrimSpace(strings.TrimRight(line[i+1:], "kB"))
-				if v, err := strconv.ParseUint(val, 10, 64); err == nil {
-					*ptr = v * 1024
-				}
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
-
-		memory.SwapUsed = memory.SwapTotal - memory.SwapFree
-		memory.Used = memory.Total - memory.Available
 
 		fmt.Printf("%d : %4d (%d/%d) %d\n", i, memory.Used*100.0/memory.Total, memory.Used, memory.Total, runtime.NumGoroutine())
 		time.Sleep(time.Second)
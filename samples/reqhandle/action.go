@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/payload"
+)
+
+// DefaultActions ... actions applied to all requests
+type DefaultActions struct {
+	*sync.RWMutex
+	values map[string]string
+}
+
+func newDefaultActions() *DefaultActions {
+	return &DefaultActions{&sync.RWMutex{}, map[string]string{}}
+}
+
+func (da *DefaultActions) get() map[string]string {
+	da.RLock()
+	defer da.RUnlock()
+	values := map[string]string{}
+	for key, value := range da.values {
+		values[key] = value
+	}
+	return values
+}
+func (da *DefaultActions) set(values map[string]string) error {
+	if err := validateActions(values); err != nil {
+		return err
+	}
+	da.Lock()
+	defer da.Unlock()
+	da.values = values
+	return nil
+}
+func (da *DefaultActions) clear() {
+	da.Lock()
+	defer da.Unlock()
+	da.values = map[string]string{}
+}
+
+// validateActions ... only action keys (not if* conditions) with valid values are accepted
+// addheaders で指定したヘッダ名のキーはヘッダの値として受け付ける
+func validateActions(values map[string]string) error {
+	headerParams := splitNames(values["addheaders"])
+	for key, value := range values {
+		re, ok := store.validator[key]
+		if !ok && headerParams[key] {
+			continue
+		}
+		if !ok || strings.HasPrefix(key, "if") || key == "persist" || key == "unpersist" {
+			return fmt.Errorf("unknown action: %s", key)
+		}
+		if len(re.FindStringSubmatch(value)) == 0 {
+			return fmt.Errorf("invalid %s = %s", key, value)
+		}
+	}
+	return nil
+}
+
+// defaultActions ... default actions of admin api overridden by actions of running scenario step
+func defaultActions() map[string]string {
+	values := store.defaults.get()
+	for key, value := range store.scenario.getActions() {
+		values[key] = value
+	}
+	return values
+}
+
+// withDefaults ... fill actions not specified by request with default actions
+func (qs *QueryString) withDefaults(defaults map[string]string) *QueryString {
+	if len(defaults) == 0 {
+		return qs
+	}
+	merged := &QueryString{existsAction: true, needsAction: true}
+	for key, value := range defaults {
+		merged.setValue(key, value)
+	}
+	for key, value := range qs.values {
+		merged.setValue(key, value)
+	}
+	return merged
+}
+
+// execute ... apply actions and return status code of response
+func (qs *QueryString) execute(respInfo *ResponseInfo) int {
+	qs.applyResource()
+	// payload 指定時は本文そのものを生成するため、ここでは dummy に埋め込む場合のみ生成する
+	if qs.Size != "" && qs.Payload == "" {
+		gen := qs.newGenerator()
+		respInfo.Dummy = string(gen.Generate(payloadSize(qs.Size)))
+		respInfo.Seed = gen.Seed
+	}
+	if qs.Upstream != "" {
+		timeout := int64(upstreamDefaultTimeout)
+		if qs.UpstreamTimeout != "" {
+			timeout, _ = strconv.ParseInt(qs.UpstreamTimeout, 10, 64)
+		}
+		respInfo.Upstreams = callUpstreams(&respInfo.Request, splitUpstreams(qs.Upstream), qs.UpstreamMode, time.Duration(timeout)*time.Millisecond)
+	}
+	qs.sleep()
+	status := http.StatusOK
+	if qs.Status != "" {
+		status, _ = strconv.Atoi(qs.Status)
+	}
+	return status
+}
+
+// sleep ... sleep for the sleep action and return slept milliseconds
+func (qs *QueryString) sleep() float64 {
+	if qs.Sleep == "" {
+		return 0
+	}
+	ms := pickNumRange(qs.Sleep)
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return float64(ms)
+}
+
+// applyHeaders ... delete headers of clearheaders and set headers of addheaders
+// addheaders の値は同名のパラメータから取得する(すでに存在する場合は上書き)
+func (qs *QueryString) applyHeaders(h http.Header) {
+	for name := range splitNames(qs.ClearHeaders) {
+		// nil をセットすることで Date/Content-Type の自動付与も抑止する
+		h[http.CanonicalHeaderKey(name)] = nil
+	}
+	for name := range splitNames(qs.AddHeaders) {
+		if value, ok := qs.values[name]; ok {
+			h.Set(name, value)
+		}
+	}
+}
+
+// splitNames ... comma separated names to set
+func splitNames(value string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// applyResource ... set resource targets of cpu/memory/io/fds/threads
+func (qs *QueryString) applyResource() {
+	// cpucores/cpupercore を指定した場合はコア単位の負荷に切り替え、全体のターゲットは解除する
+	switch {
+	case qs.CPUPerCore != "":
+		store.resource.CPU.setTarget(0)
+		store.resource.coreTargets.set(parseCoreTargets(qs.CPUPerCore))
+	case qs.CPUCores != "":
+		target := float64(100)
+		if qs.CPU != "" {
+			target, _ = strconv.ParseFloat(qs.CPU, 64)
+		}
+		n, _ := strconv.Atoi(qs.CPUCores)
+		if n > runtime.NumCPU() {
+			n = runtime.NumCPU()
+		}
+		targets := map[int]float64{}
+		for core := 0; core < n; core++ {
+			targets[core] = target
+		}
+		store.resource.CPU.setTarget(0)
+		store.resource.coreTargets.set(targets)
+	case qs.CPU != "":
+		v, _ := strconv.ParseFloat(qs.CPU, 64)
+		store.resource.coreTargets.set(nil)
+		store.resource.CPU.setTarget(v)
+	}
+	if qs.Memory != "" {
+		v, _ := strconv.ParseFloat(qs.Memory, 64)
+		store.resource.Memory.setTarget(v)
+	}
+	if qs.IO != "" {
+		v, _ := strconv.ParseFloat(qs.IO, 64)
+		store.resource.IO.setTarget(v)
+	}
+	if qs.FDs != "" {
+		store.resource.FDs.setTarget(resolveFDs(qs.FDs))
+	}
+	if qs.Threads != "" {
+		v, _ := strconv.ParseFloat(qs.Threads, 64)
+		store.resource.Threads.setTarget(resolveThreads(v))
+	}
+}
+
+// newGenerator ... payload generator of payload/seed/pattern
+func (qs *QueryString) newGenerator() *payload.Generator {
+	mode, _ := payload.ParseMode(qs.Payload)
+	seed, _ := strconv.ParseInt(qs.Seed, 10, 64)
+	return payload.New(payload.Option{Mode: mode, Seed: seed, Pattern: qs.Pattern})
+}
+
+// generatePayload ... body of size bytes replacing response json
+func (qs *QueryString) generatePayload() ([]byte, *payload.Generator) {
+	gen := qs.newGenerator()
+	size := 0
+	if qs.Size != "" {
+		size = payloadSize(qs.Size)
+	}
+	return gen.Generate(size), gen
+}
+
+// PayloadOption ... limits of generated payload
+type PayloadOption struct {
+	MaxSize int
+}
+
+// payloadSize ... bytes of size= (clamped to -max-size)
+func payloadSize(value string) int {
+	size := pickNumRange(value)
+	if size > int64(payloadOption.MaxSize) {
+		size = int64(payloadOption.MaxSize)
+	}
+	return int(size)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// AdminOption ... settings of admin listener
+type AdminOption struct {
+	Addr  string
+	Token string
+}
+
+// ResourceTarget ... request body of /resource
+type ResourceTarget struct {
+	CPU     *float64        `json:"cpu,omitempty"`
+	Memory  *float64        `json:"memory,omitempty"`
+	Cores   map[int]float64 `json:"cores,omitempty"`
+	IO      *float64        `json:"io,omitempty"`
+	FDs     *string         `json:"fds,omitempty"`
+	Threads *float64        `json:"threads,omitempty"`
+}
+
+// HealthTarget ... request body of /health
+type HealthTarget struct {
+	Healthy   *bool   `json:"healthy,omitempty"`
+	Flap      *int64  `json:"flap,omitempty"`
+	FailEvery *int64  `json:"failevery,omitempty"`
+	Sleep     *string `json:"sleep,omitempty"`
+}
+
+// StoreInfo ... current state of DataStore
+type StoreInfo struct {
+	Host     HostInfo          `json:"host"`
+	Resource ResourceInfo      `json:"resource"`
+	Health   HealthState       `json:"health"`
+	Defaults map[string]string `json:"defaults"`
+	Rules    []Rule            `json:"rules"`
+	Scenario *ScenarioStatus   `json:"scenario,omitempty"`
+}
+
+// ScenarioInfo ... loaded scenario and its progress
+type ScenarioInfo struct {
+	Status   *ScenarioStatus `json:"status"`
+	Scenario *Scenario       `json:"scenario"`
+}
+
+// RuleTarget ... request body of /rules
+type RuleTarget struct {
+	Actions    map[string]string `json:"actions"`
+	Conditions map[string]string `json:"conditions,omitempty"`
+	TTL        string            `json:"ttl"`
+}
+
+func newAdminServer(opt *AdminOption) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resource", adminResourceHandler)
+	mux.HandleFunc("/defaults", adminDefaultsHandler)
+	mux.HandleFunc("/health", adminHealthHandler)
+	mux.HandleFunc("/rules", adminRulesHandler)
+	mux.HandleFunc("/scenario", adminScenarioHandler)
+	mux.HandleFunc("/store", adminStoreHandler)
+	mux.HandleFunc("/proxy", adminProxyHandler)
+	mux.HandleFunc("/cookies", adminCookiesHandler)
+	mux.HandleFunc("/connections", adminConnectionsHandler)
+	mux.HandleFunc("/metrics", adminMetricsHandler)
+	return &http.Server{
+		Addr:    opt.Addr,
+		Handler: withAdminToken(opt.Token, mux),
+	}
+}
+
+// withAdminToken ... require "Authorization: Bearer <token>" when token is set
+func withAdminToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	s, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("failed to json.Marshal: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", string(s))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func adminResourceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		target := ResourceTarget{}
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		values := []*float64{target.CPU, target.Memory}
+		for core, v := range target.Cores {
+			if core < 0 || runtime.NumCPU() <= core {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("core must be 0-%d: %d", runtime.NumCPU()-1, core))
+				return
+			}
+			v := v
+			values = append(values, &v)
+		}
+		for _, v := range values {
+			if v != nil && (*v < 0 || 100 < *v) {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("target must be 0-100: %v", *v))
+				return
+			}
+		}
+		if target.IO != nil && *target.IO < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("io must not be negative: %v", *target.IO))
+			return
+		}
+		if target.Threads != nil && *target.Threads < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("threads must not be negative: %v", *target.Threads))
+			return
+		}
+		if target.FDs != nil && len(store.validator["fds"].FindStringSubmatch(*target.FDs)) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid fds = %s", *target.FDs))
+			return
+		}
+		if target.Cores != nil {
+			store.resource.CPU.setTarget(0)
+			store.resource.coreTargets.set(target.Cores)
+		}
+		if target.CPU != nil {
+			store.resource.coreTargets.set(nil)
+			store.resource.CPU.setTarget(*target.CPU)
+		}
+		if target.Memory != nil {
+			store.resource.Memory.setTarget(*target.Memory)
+		}
+		if target.IO != nil {
+			store.resource.IO.setTarget(*target.IO)
+		}
+		if target.FDs != nil {
+			store.resource.FDs.setTarget(resolveFDs(*target.FDs))
+		}
+		if target.Threads != nil {
+			store.resource.Threads.setTarget(resolveThreads(*target.Threads))
+		}
+	case http.MethodDelete:
+		store.resource.CPU.setTarget(0)
+		store.resource.coreTargets.set(nil)
+		store.resource.Memory.setTarget(0)
+		store.resource.IO.setTarget(0)
+		store.resource.FDs.setTarget(0)
+		store.resource.Threads.setTarget(0)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.getResourceInfo())
+}
+
+func adminDefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		values := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := store.defaults.set(values); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	case http.MethodDelete:
+		store.defaults.clear()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.defaults.get())
+}
+
+func adminHealthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		target := HealthTarget{}
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if target.Sleep != nil && *target.Sleep != "" && len(store.validator["healthsleep"].FindStringSubmatch(*target.Sleep)) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid sleep = %s", *target.Sleep))
+			return
+		}
+		if target.Flap != nil && *target.Flap < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("flap must not be negative: %d", *target.Flap))
+			return
+		}
+		if target.FailEvery != nil && *target.FailEvery < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failevery must not be negative: %d", *target.FailEvery))
+			return
+		}
+		if target.Healthy != nil {
+			store.health.setHealthy(*target.Healthy)
+		}
+		if target.Flap != nil {
+			store.health.setFlap(*target.Flap)
+		}
+		if target.FailEvery != nil {
+			store.health.setFailEvery(*target.FailEvery)
+		}
+		if target.Sleep != nil {
+			store.health.setSleep(*target.Sleep)
+		}
+	case http.MethodDelete:
+		store.health.reset()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.health.getClone())
+}
+
+func adminStoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, StoreInfo{
+		Host:     store.host,
+		Resource: store.getResourceInfo(),
+		Health:   store.health.getClone(),
+		Defaults: store.defaults.get(),
+		Rules:    store.rules.list(),
+		Scenario: store.scenario.getStatus(),
+	})
+}
+
+func adminRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		target := RuleTarget{}
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateActions(target.Actions); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		for key, value := range target.Conditions {
+			re, ok := store.validator[key]
+			if !ok || !strings.HasPrefix(key, "if") || len(re.FindStringSubmatch(value)) == 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid condition %s = %s", key, value))
+				return
+			}
+		}
+		if len(store.validator["persist"].FindStringSubmatch(target.TTL)) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl = %s", target.TTL))
+			return
+		}
+		store.rules.add(target.Actions, target.Conditions, parseTTL(target.TTL))
+	case http.MethodDelete:
+		// 誤って全削除しないよう、全削除は ?all=true を明示した場合のみとする
+		id := r.URL.Query().Get("id")
+		if r.URL.Query().Get("all") == "true" {
+			id = "all"
+		} else if id == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("id or all=true is required"))
+			return
+		}
+		if !store.rules.remove(id) && id != "all" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("rule not found: %s", id))
+			return
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.rules.list())
+}
+
+func adminScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		scenario, err := parseScenario(data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		store.scenario.start(scenario)
+	case http.MethodDelete:
+		store.scenario.cancel()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, ScenarioInfo{store.scenario.getStatus(), store.scenario.getScenario()})
+}
+
+func adminProxyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		store.proxy.clear()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.proxy.list())
+}
+
+func adminCookiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		store.cookies.clear()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.cookies.list())
+}
+
+func adminConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		store.conns.clear()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, store.conns.info())
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 切断済みの接続を保持する件数
+const closedConnLogSize = 100
+
+// close reasons of connection
+const (
+	closeIdleTimeout = "idle timeout" // server closed idle connection after IdleTimeout
+	closeClient      = "client close" // client closed (or reset) connection
+	closeServer      = "server close" // server closed connection (Connection: close, shutdown etc.)
+	closeHijacked    = "hijacked"     // connection was taken over by handler (malformed=)
+)
+
+// ConnOption ... settings of client connections
+type ConnOption struct {
+	IdleTimeout int
+}
+
+// ConnInfo ... connection which carried the request
+// Sequence はこの接続で何番目のリクエストか(2 以上なら接続が再利用されている)
+// IdleGap は前のリクエストの応答後にアイドルだった時間(ミリ秒、HTTP/1.x のみ)
+type ConnInfo struct {
+	ID         uint64    `json:"id"`
+	AcceptedAt time.Time `json:"acceptedat"`
+	Sequence   int64     `json:"sequence"`
+	Reused     bool      `json:"reused"`
+	IdleGap    float64   `json:"idlegap"`
+}
+
+// ConnStats ... stats of one connection
+type ConnStats struct {
+	ID          uint64       `json:"id"`
+	Local       string       `json:"local"`
+	Remote      string       `json:"remote"`
+	AcceptedAt  time.Time    `json:"acceptedat"`
+	State       string       `json:"state"`
+	Requests    int64        `json:"requests"`
+	IdleGaps    IdleGapStats `json:"idlegaps"`
+	LastActive  *time.Time   `json:"lastactive,omitempty"`
+	ClosedAt    *time.Time   `json:"closedat,omitempty"`
+	CloseReason string       `json:"closereason,omitempty"`
+	idleSince   time.Time
+	readErr     error
+}
+
+// IdleGapStats ... idle time between requests on one connection (milliseconds)
+type IdleGapStats struct {
+	Count int64   `json:"count"`
+	Last  float64 `json:"last"`
+	Max   float64 `json:"max"`
+	Total float64 `json:"total"`
+}
+
+// ConnTableInfo ... response of /connections
+type ConnTableInfo struct {
+	Accepted uint64           `json:"accepted"`
+	Closed   map[string]int64 `json:"closed"`
+	Current  []ConnStats      `json:"current"`
+	Recent   []ConnStats      `json:"recent"`
+}
+
+// ConnTable ... current and recently closed connections
+// 接続はローカルアドレスとリモートアドレスの組で識別する(TLS の接続も同じキーで引ける)
+type ConnTable struct {
+	*sync.RWMutex
+	nextID  uint64
+	conns   map[string]*ConnStats
+	recent  []ConnStats
+	reasons map[string]int64
+}
+
+func newConnTable() *ConnTable {
+	return &ConnTable{RWMutex: &sync.RWMutex{}, conns: map[string]*ConnStats{}, reasons: map[string]int64{}}
+}
+
+func connKey(local, remote string) string {
+	return local + "-" + remote
+}
+
+// setState ... ConnState hook of http.Server
+func (ct *ConnTable) setState(c net.Conn, state http.ConnState) {
+	ct.Lock()
+	defer ct.Unlock()
+	key := connKey(c.LocalAddr().String(), c.RemoteAddr().String())
+	now := time.Now()
+	stats, ok := ct.conns[key]
+	if !ok {
+		ct.nextID++
+		stats = &ConnStats{
+			ID:         ct.nextID,
+			Local:      c.LocalAddr().String(),
+			Remote:     c.RemoteAddr().String(),
+			AcceptedAt: now,
+			State:      http.StateNew.String(),
+		}
+		ct.conns[key] = stats
+	}
+	switch state {
+	case http.StateActive:
+		if !stats.idleSince.IsZero() {
+			gap := float64(now.Sub(stats.idleSince).Microseconds()) / 1000
+			stats.IdleGaps.Count++
+			stats.IdleGaps.Last = gap
+			stats.IdleGaps.Total += gap
+			if gap > stats.IdleGaps.Max {
+				stats.IdleGaps.Max = gap
+			}
+			stats.idleSince = time.Time{}
+		}
+	case http.StateIdle:
+		// 応答処理中の読み込み中断によるタイムアウトはアイドルタイムアウトではないため捨てる
+		stats.idleSince = now
+		stats.readErr = nil
+	case http.StateHijacked, http.StateClosed:
+		stats.CloseReason = closeReason(stats, state)
+		stats.ClosedAt = &now
+		stats.State = state.String()
+		ct.reasons[stats.CloseReason]++
+		ct.recent = append(ct.recent, *stats)
+		if len(ct.recent) > closedConnLogSize {
+			ct.recent = ct.recent[len(ct.recent)-closedConnLogSize:]
+		}
+		delete(ct.conns, key)
+		return
+	}
+	stats.State = state.String()
+}
+
+// closeReason ... why connection is closed, decided by last state and read error
+func closeReason(stats *ConnStats, state http.ConnState) string {
+	if state == http.StateHijacked {
+		return closeHijacked
+	}
+	if stats.readErr != nil {
+		var ne net.Error
+		if errors.As(stats.readErr, &ne) && ne.Timeout() {
+			if stats.State == http.StateIdle.String() || stats.State == http.StateNew.String() {
+				return closeIdleTimeout
+			}
+			return closeServer
+		}
+		return closeClient
+	}
+	return closeServer
+}
+
+// readError ... record error returned by Read of connection
+func (ct *ConnTable) readError(key string, err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	ct.Lock()
+	defer ct.Unlock()
+	if stats, ok := ct.conns[key]; ok {
+		stats.readErr = err
+	}
+}
+
+// request ... count request on connection of r
+func (ct *ConnTable) request(r *http.Request) *ConnInfo {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	ct.Lock()
+	defer ct.Unlock()
+	stats, ok := ct.conns[connKey(local.String(), r.RemoteAddr)]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	stats.Requests++
+	stats.LastActive = &now
+	info := &ConnInfo{
+		ID:         stats.ID,
+		AcceptedAt: stats.AcceptedAt,
+		Sequence:   stats.Requests,
+		Reused:     stats.Requests > 1,
+	}
+	if stats.Requests > 1 {
+		info.IdleGap = stats.IdleGaps.Last
+	}
+	return info
+}
+
+func (ct *ConnTable) info() ConnTableInfo {
+	ct.RLock()
+	defer ct.RUnlock()
+	info := ConnTableInfo{
+		Accepted: ct.nextID,
+		Closed:   map[string]int64{},
+		Current:  make([]ConnStats, 0, len(ct.conns)),
+		Recent:   make([]ConnStats, len(ct.recent)),
+	}
+	for reason, n := range ct.reasons {
+		info.Closed[reason] = n
+	}
+	for _, stats := range ct.conns {
+		info.Current = append(info.Current, *stats)
+	}
+	sort.Slice(info.Current, func(i, j int) bool {
+		return info.Current[i].ID < info.Current[j].ID
+	})
+	copy(info.Recent, ct.recent)
+	return info
+}
+
+// clear ... forget closed connections (現在の接続と ID の採番はそのまま)
+func (ct *ConnTable) clear() {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.recent = nil
+	ct.reasons = map[string]int64{}
+}
+
+// trackListener ... listener whose connections report read errors to decide close reason
+type trackListener struct {
+	net.Listener
+}
+
+func (l *trackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackConn{c, connKey(c.LocalAddr().String(), c.RemoteAddr().String())}, nil
+}
+
+type trackConn struct {
+	net.Conn
+	key string
+}
+
+func (c *trackConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		store.conns.readError(c.key, err)
+	}
+	return n, err
+}
+
+type connContextKey struct{}
+
+// withConnTracking ... count request on its connection and pass ConnInfo to handler
+func withConnTracking(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := store.conns.request(r); info != nil {
+			r = r.WithContext(context.WithValue(r.Context(), connContextKey{}, info))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestConn ... ConnInfo of request set by withConnTracking
+func requestConn(r *http.Request) *ConnInfo {
+	info, _ := r.Context().Value(connContextKey{}).(*ConnInfo)
+	return info
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 値ごとのカウンタの上限(超えた場合は最後に参照された時刻が最も古いものから捨てる)
+const cookieCounterSize = 10000
+
+// kinds of sticky cookie
+const (
+	cookieKindALB     = "alb"     // duration-based stickiness (AWSALB)
+	cookieKindALBCORS = "albcors" // duration-based stickiness for CORS (AWSALBCORS)
+	cookieKindALBApp  = "albapp"  // application-based stickiness (AWSALBAPP-N)
+	cookieKindApp     = "app"     // application cookie set by setcookie=
+)
+
+// StickinessInfo ... sticky cookies of request and whether client stuck to this target
+type StickinessInfo struct {
+	Target  string         `json:"target"`
+	Cookies []StickyCookie `json:"cookies"`
+	Set     string         `json:"set,omitempty"`
+}
+
+// StickyCookie ... one sticky cookie of request
+// Count はこのターゲットが同じ値を受け取った回数で、2 以上ならクライアントはこのターゲットに固定されている
+type StickyCookie struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	Kind      string    `json:"kind"`
+	Count     int64     `json:"count"`
+	Stuck     bool      `json:"stuck"`
+	FirstSeen time.Time `json:"firstseen"`
+}
+
+// CookieCount ... number of requests with the same cookie value
+type CookieCount struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"firstseen"`
+	LastSeen  time.Time `json:"lastseen"`
+}
+
+// CookieCounter ... counters of sticky cookie values and names of app cookies
+// recent は最後に参照された順(先頭が最新)の *CookieCount のリストで、上限を超えた場合は末尾から捨てる
+type CookieCounter struct {
+	*sync.RWMutex
+	counts   map[string]*list.Element
+	recent   *list.List
+	appNames map[string]bool
+}
+
+func newCookieCounter() *CookieCounter {
+	return &CookieCounter{&sync.RWMutex{}, map[string]*list.Element{}, list.New(), map[string]bool{}}
+}
+
+// count ... count up value of cookie and return its counter
+func (cc *CookieCounter) count(name, value string) CookieCount {
+	cc.Lock()
+	defer cc.Unlock()
+	key := name + "=" + value
+	now := time.Now()
+	e, ok := cc.counts[key]
+	if ok {
+		cc.recent.MoveToFront(e)
+	} else {
+		if len(cc.counts) >= cookieCounterSize {
+			cc.evict()
+		}
+		e = cc.recent.PushFront(&CookieCount{Name: name, Value: value, FirstSeen: now})
+		cc.counts[key] = e
+	}
+	c := e.Value.(*CookieCount)
+	c.Count++
+	c.LastSeen = now
+	return *c
+}
+
+// evict ... remove counter which was referred least recently
+func (cc *CookieCounter) evict() {
+	if e := cc.recent.Back(); e != nil {
+		c := cc.recent.Remove(e).(*CookieCount)
+		delete(cc.counts, c.Name+"="+c.Value)
+	}
+}
+
+func (cc *CookieCounter) addAppName(name string) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.appNames[name] = true
+}
+func (cc *CookieCounter) isAppName(name string) bool {
+	cc.RLock()
+	defer cc.RUnlock()
+	return cc.appNames[name]
+}
+func (cc *CookieCounter) list() []CookieCount {
+	cc.RLock()
+	defer cc.RUnlock()
+	counts := make([]CookieCount, 0, len(cc.counts))
+	for e := cc.recent.Front(); e != nil; e = e.Next() {
+		counts = append(counts, *e.Value.(*CookieCount))
+	}
+	return counts
+}
+func (cc *CookieCounter) clear() {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.counts = map[string]*list.Element{}
+	cc.recent.Init()
+}
+
+// stickyCookieKind ... kind of sticky cookie (empty: not sticky cookie)
+func stickyCookieKind(name string) string {
+	switch {
+	case name == "AWSALB":
+		return cookieKindALB
+	case name == "AWSALBCORS":
+		return cookieKindALBCORS
+	case strings.HasPrefix(name, "AWSALBAPP-"):
+		return cookieKindALBApp
+	case store.cookies.isAppName(name):
+		return cookieKindApp
+	}
+	return ""
+}
+
+// applyStickiness ... set app cookie of setcookie= and count sticky cookies of request
+func (qs *QueryString) applyStickiness(r *http.Request, reqInfo *RequestInfo, h http.Header) *StickinessInfo {
+	info := &StickinessInfo{Target: store.host.Name + "/" + store.host.IP, Cookies: []StickyCookie{}}
+	if qs.SetCookie != "" {
+		store.cookies.addAppName(qs.SetCookie)
+		info.Set = qs.newCookie(r, reqInfo).String()
+		h.Add("Set-Cookie", info.Set)
+	}
+	for _, cookie := range r.Cookies() {
+		kind := stickyCookieKind(cookie.Name)
+		if kind == "" {
+			continue
+		}
+		c := store.cookies.count(cookie.Name, cookie.Value)
+		info.Cookies = append(info.Cookies, StickyCookie{
+			Name:      cookie.Name,
+			Value:     cookie.Value,
+			Kind:      kind,
+			Count:     c.Count,
+			Stuck:     c.Count > 1,
+			FirstSeen: c.FirstSeen,
+		})
+	}
+	if info.Set == "" && len(info.Cookies) == 0 {
+		return nil
+	}
+	return info
+}
+
+// newCookie ... app cookie of setcookie/cookievalue/cookiettl/cookieattrs
+// cookievalue を省略した場合はクライアントごとに異なるランダムな値とする
+func (qs *QueryString) newCookie(r *http.Request, reqInfo *RequestInfo) *http.Cookie {
+	cookie := &http.Cookie{Name: qs.SetCookie, Path: "/"}
+	if qs.CookieValue != "" {
+		cookie.Value = expandTemplate(qs.CookieValue, r, reqInfo)
+	} else {
+		b := make([]byte, 8)
+		rand.Read(b)
+		cookie.Value = hex.EncodeToString(b)
+	}
+	if qs.CookieTTL != "" {
+		ttl, _ := strconv.Atoi(qs.CookieTTL)
+		cookie.MaxAge = ttl
+		cookie.Expires = time.Now().Add(time.Duration(ttl) * time.Second).UTC()
+		if ttl == 0 {
+			cookie.MaxAge = -1
+		}
+	}
+	for attr := range splitNames(qs.CookieAttrs) {
+		switch attr {
+		case "secure":
+			cookie.Secure = true
+		case "httponly":
+			cookie.HttpOnly = true
+		case "samesite-lax":
+			cookie.SameSite = http.SameSiteLaxMode
+		case "samesite-strict":
+			cookie.SameSite = http.SameSiteStrictMode
+		case "samesite-none":
+			cookie.SameSite = http.SameSiteNoneMode
+		}
+	}
+	return cookie
+}
+
+// applyRedirect ... set Location of redirect= and return status code (0: no redirect)
+func (qs *QueryString) applyRedirect(r *http.Request, reqInfo *RequestInfo, h http.Header) int {
+	if qs.Redirect == "" {
+		return 0
+	}
+	location := "/"
+	if qs.Location != "" {
+		location = expandTemplate(qs.Location, r, reqInfo)
+	}
+	h.Set("Location", location)
+	status, _ := strconv.Atoi(qs.Redirect)
+	return status
+}
+
+// expandTemplate ... replace placeholders of location/cookievalue
+// {scheme} {host} {path} {query} {hostname} {hostip} {az} {clientip} {traceid}
+func expandTemplate(tmpl string, r *http.Request, reqInfo *RequestInfo) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", r.Host,
+		"{path}", r.URL.EscapedPath(),
+		"{query}", r.URL.RawQuery,
+		"{hostname}", store.host.Name,
+		"{hostip}", store.host.IP,
+		"{az}", store.host.AZ,
+		"{clientip}", reqInfo.ClientIP,
+		"{traceid}", reqInfo.TraceID,
+	).Replace(tmpl)
+}
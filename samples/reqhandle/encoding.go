@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// content codings
+// rawdeflate は zlib ヘッダのない deflate(Content-Encoding は deflate として送る)
+const (
+	codingGzip       = "gzip"
+	codingDeflate    = "deflate"
+	codingRawDeflate = "rawdeflate"
+	codingBrotli     = "br"
+	codingIdentity   = "identity"
+	codingNone       = "none"
+)
+
+// headers of original/encoded size (本文に含められない payload でもサイズを確認できるようにする)
+const (
+	originalSizeHeader = "X-Encoding-Original-Size"
+	encodedSizeHeader  = "X-Encoding-Encoded-Size"
+)
+
+// 応答に含めるサイズと実際の本文のサイズが一致するまで再エンコードする回数の上限
+const maxEncodePasses = 5
+
+// negotiation order when q values are same
+var codingPreference = []string{codingBrotli, codingGzip, codingDeflate}
+
+// EncodingOption ... settings of response compression
+type EncodingOption struct {
+	Compress bool
+}
+
+// EncodingInfo ... content codings applied to response body
+// Codings は適用順、Header は実際に送った Content-Encoding
+type EncodingInfo struct {
+	Codings      []string `json:"codings"`
+	Header       string   `json:"header"`
+	OriginalSize int      `json:"originalsize"`
+	EncodedSize  int      `json:"encodedsize"`
+}
+
+// negotiateEncoding ... coding with highest q in Accept-Encoding (empty: identity)
+func negotiateEncoding(acceptEncoding string) string {
+	qvalues := map[string]float64{}
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				q, _ = strconv.ParseFloat(kv[1], 64)
+			}
+		}
+		qvalues[coding] = q
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range codingPreference {
+		q, ok := qvalues[coding]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// contentCodings ... codings forced by encoding= or negotiated from Accept-Encoding
+func (qs *QueryString) contentCodings(r *http.Request, h http.Header) []string {
+	if qs.Encoding != "" {
+		codings := []string{}
+		for _, coding := range strings.Split(qs.Encoding, ",") {
+			if coding != codingIdentity {
+				codings = append(codings, coding)
+			}
+		}
+		return codings
+	}
+	if !encodingOption.Compress {
+		return nil
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if coding := negotiateEncoding(r.Header.Get("Accept-Encoding")); coding != "" {
+		return []string{coding}
+	}
+	return nil
+}
+
+// contentEncodingHeader ... value of Content-Encoding (contentencoding= で本文と異なる値を送れる)
+func (qs *QueryString) contentEncodingHeader(codings []string) string {
+	if qs.ContentEncoding != "" {
+		if qs.ContentEncoding == codingNone {
+			return ""
+		}
+		return strings.Join(strings.Split(qs.ContentEncoding, ","), ", ")
+	}
+	names := make([]string, len(codings))
+	for i, coding := range codings {
+		if coding == codingRawDeflate {
+			coding = codingDeflate
+		}
+		names[i] = coding
+	}
+	return strings.Join(names, ", ")
+}
+
+// compress ... apply codings to body in order
+func compress(body []byte, codings []string) ([]byte, error) {
+	for _, coding := range codings {
+		buf := &bytes.Buffer{}
+		var w io.WriteCloser
+		switch coding {
+		case codingGzip:
+			w = gzip.NewWriter(buf)
+		case codingDeflate:
+			w = zlib.NewWriter(buf)
+		case codingRawDeflate:
+			w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+		case codingBrotli:
+			w = brotli.NewWriter(buf)
+		default:
+			return nil, fmt.Errorf("unknown coding: %s", coding)
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	return body, nil
+}
+
+// encodeResponse ... render respInfo and compress it with codings
+// 応答に含めるサイズが本文と一致するまで繰り返す(一致しない場合もヘッダのサイズは正確)
+func encodeResponse(r *http.Request, respInfo *ResponseInfo, codings []string, header string) (body, encoded []byte, contentType string, err error) {
+	info := EncodingInfo{Codings: codings, Header: header}
+	for i := 0; i < maxEncodePasses; i++ {
+		if len(codings) > 0 {
+			reported := info
+			respInfo.Encoding = &reported
+		}
+		body, contentType, err = renderer.Encode(r, respInfo)
+		if err != nil {
+			return
+		}
+		encoded, err = compress(body, codings)
+		if err != nil || len(codings) == 0 {
+			return
+		}
+		if info.OriginalSize == len(body) && info.EncodedSize == len(encoded) {
+			return
+		}
+		info.OriginalSize, info.EncodedSize = len(body), len(encoded)
+	}
+	return
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 受信データのうちヘッダの取得用に保持する量(MaxHeaderBytes に加える先読み分)
+const captureMargin = 64 << 10
+
+// HeaderOption ... limits of request header
+type HeaderOption struct {
+	MaxHeaderBytes int
+}
+
+// HeaderStats ... size of request header and url
+// Raw は受信したままの順序と大文字小文字のヘッダ(平文のリスナでのみ取得できる)
+// Bytes はリクエスト行と終端の空行を含むヘッダ部のサイズ(Raw がない場合は r.Header からの推定値)
+type HeaderStats struct {
+	Count     int         `json:"count"`
+	Bytes     int         `json:"bytes"`
+	Largest   HeaderEntry `json:"largest"`
+	URLLength int         `json:"urllength"`
+	Captured  bool        `json:"captured"`
+	Raw       []string    `json:"raw,omitempty"`
+}
+
+// HeaderEntry ... size of one header line
+type HeaderEntry struct {
+	Name  string `json:"name"`
+	Bytes int    `json:"bytes"`
+}
+
+type captureContextKey struct{}
+type headerStatsContextKey struct{}
+
+// captureListener ... listener whose connections keep bytes read for raw header capture
+type captureListener struct {
+	net.Listener
+	size int
+}
+
+func (l *captureListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &captureConn{Conn: c, Mutex: &sync.Mutex{}, size: l.size}, nil
+}
+
+// captureConn ... connection which keeps last bytes read
+// net/http は bufio で先読みするため、ハンドラからはリクエスト行を手がかりにヘッダ部を切り出す
+type captureConn struct {
+	net.Conn
+	*sync.Mutex
+	buf  []byte
+	size int
+	skip int64 // まだ受信していない本文のバイト数(保持しない)
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.Lock()
+		data := b[:n]
+		if c.skip > 0 {
+			skip := c.skip
+			if skip > int64(len(data)) {
+				skip = int64(len(data))
+			}
+			data, c.skip = data[skip:], c.skip-skip
+		}
+		c.buf = append(c.buf, data...)
+		if len(c.buf) > c.size {
+			c.buf = append([]byte{}, c.buf[len(c.buf)-c.size:]...)
+		}
+		c.Unlock()
+	}
+	return n, err
+}
+
+// rawHeader ... header section starting with requestLine
+// ヘッダ部と bodyLength バイトの本文は破棄し、次のリクエストが先頭になるようにする
+// 見つからない場合も保持したデータは破棄し、後続のリクエストが古いヘッダに一致しないようにする
+func (c *captureConn) rawHeader(requestLine string, bodyLength int64) []byte {
+	c.Lock()
+	defer c.Unlock()
+	buf := c.buf
+	c.buf = nil
+	start := -1
+	for offset := 0; offset < len(buf); {
+		i := bytes.Index(buf[offset:], []byte(requestLine))
+		if i < 0 {
+			break
+		}
+		if i += offset; i == 0 || buf[i-1] == '\n' {
+			start = i
+			break
+		}
+		offset = i + 1
+	}
+	if start < 0 {
+		return nil
+	}
+	end := -1
+	for _, terminator := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(buf[start:], []byte(terminator)); i >= 0 && (end < 0 || start+i+len(terminator) < end) {
+			end = start + i + len(terminator)
+		}
+	}
+	if end < 0 {
+		return nil
+	}
+	raw := append([]byte{}, buf[start:end]...)
+	if bodyLength > 0 {
+		if rest := int64(len(buf) - end); bodyLength > rest {
+			c.skip = bodyLength - rest
+			end = len(buf)
+		} else {
+			end += int(bodyLength)
+		}
+	}
+	if end < len(buf) {
+		c.buf = append([]byte{}, buf[end:]...)
+	}
+	return raw
+}
+
+// withCaptureConn ... ConnContext of http.Server to pass captureConn to handler
+func withCaptureConn(ctx context.Context, c net.Conn) context.Context {
+	if cc, ok := c.(*captureConn); ok {
+		return context.WithValue(ctx, captureContextKey{}, cc)
+	}
+	return ctx
+}
+
+// withHeaderCapture ... take header of every request out of captureConn before other handlers
+// ヘルスチェックなど HeaderStats を使わないリクエストのヘッダも消費しないと次のリクエストで誤って一致する
+func withHeaderCapture(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), headerStatsContextKey{}, newHeaderStats(r)))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestHeaderStats ... HeaderStats of request set by withHeaderCapture
+func requestHeaderStats(r *http.Request) *HeaderStats {
+	if stats, ok := r.Context().Value(headerStatsContextKey{}).(*HeaderStats); ok {
+		return stats
+	}
+	return newHeaderStats(r)
+}
+
+// newHeaderStats ... stats of raw header if captured, otherwise estimated from r.Header
+func newHeaderStats(r *http.Request) *HeaderStats {
+	stats := &HeaderStats{URLLength: len(r.RequestURI)}
+	requestLine := r.Method + " " + r.RequestURI + " "
+	if cc, ok := r.Context().Value(captureContextKey{}).(*captureConn); ok {
+		if raw := cc.rawHeader(requestLine, r.ContentLength); raw != nil {
+			stats.Captured = true
+			stats.Bytes = len(raw)
+			stats.Raw = parseRawHeader(raw)
+		}
+	}
+	if !stats.Captured {
+		lines := []string{"Host: " + r.Host}
+		for name, values := range r.Header {
+			for _, value := range values {
+				lines = append(lines, name+": "+value)
+			}
+		}
+		sort.Strings(lines)
+		stats.Bytes = len(requestLine) + len(r.Proto) + 2 + 2
+		for _, line := range lines {
+			stats.Bytes += len(line) + 2
+		}
+		stats.Count = len(lines)
+		stats.Largest = largestHeader(lines)
+		return stats
+	}
+	stats.Count = len(stats.Raw)
+	stats.Largest = largestHeader(stats.Raw)
+	return stats
+}
+
+// parseRawHeader ... header lines without request line (obs-fold は前の行に連結する)
+func parseRawHeader(raw []byte) []string {
+	lines := []string{}
+	for i, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if i == 0 {
+			continue
+		}
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func largestHeader(lines []string) HeaderEntry {
+	largest := HeaderEntry{}
+	for _, line := range lines {
+		if len(line)+2 > largest.Bytes {
+			largest = HeaderEntry{strings.SplitN(line, ":", 2)[0], len(line) + 2}
+		}
+	}
+	return largest
+}
+
+// applyLimits ... status code of limitheader=/limiturl= (0: within limits)
+func (qs *QueryString) applyLimits(reqInfo *RequestInfo) int {
+	if qs.LimitHeader != "" {
+		limit, _ := strconv.Atoi(qs.LimitHeader)
+		if reqInfo.HeaderStats.Bytes > limit {
+			return http.StatusRequestHeaderFieldsTooLarge
+		}
+	}
+	if qs.LimitURL != "" {
+		limit, _ := strconv.Atoi(qs.LimitURL)
+		if reqInfo.HeaderStats.URLLength > limit {
+			return http.StatusRequestURITooLong
+		}
+	}
+	return 0
+}
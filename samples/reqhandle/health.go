@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const healthCheckerUA = "ELB-HealthChecker"
+
+// HealthState ... controllable state of health check
+type HealthState struct {
+	*sync.RWMutex
+	Healthy   bool   `json:"healthy"`
+	Flap      int64  `json:"flap,omitempty"`
+	FailEvery int64  `json:"failevery,omitempty"`
+	Sleep     string `json:"sleep,omitempty"`
+	Checks    int64  `json:"checks"`
+	Failures  int64  `json:"failures"`
+	Requests  int64  `json:"requests"`
+	Draining  bool   `json:"draining"`
+	flapFrom  time.Time
+}
+
+func newHealthState() *HealthState {
+	return &HealthState{RWMutex: &sync.RWMutex{}, Healthy: true}
+}
+
+func (hs *HealthState) getClone() HealthState {
+	hs.RLock()
+	defer hs.RUnlock()
+	return *hs
+}
+func (hs *HealthState) setHealthy(healthy bool) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Healthy = healthy
+}
+func (hs *HealthState) setFlap(sec int64) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Flap = sec
+	hs.flapFrom = time.Now()
+}
+func (hs *HealthState) setFailEvery(n int64) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.FailEvery = n
+}
+func (hs *HealthState) setSleep(value string) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Sleep = value
+}
+func (hs *HealthState) isDraining() bool {
+	hs.RLock()
+	defer hs.RUnlock()
+	return hs.Draining
+}
+func (hs *HealthState) setDraining(draining bool) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Draining = draining
+}
+func (hs *HealthState) countRequest() {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Requests++
+}
+
+// check ... count up health check and decide the result of it
+func (hs *HealthState) check() bool {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Checks++
+	healthy := hs.Healthy && !hs.Draining
+	if healthy && hs.Flap > 0 {
+		// Flap 秒ごとに healthy/unhealthy を切り替える
+		phase := int64(time.Since(hs.flapFrom).Seconds()) / hs.Flap
+		healthy = phase%2 == 0
+	}
+	if healthy && hs.FailEvery > 0 && hs.Checks%hs.FailEvery == 0 {
+		healthy = false
+	}
+	if !healthy {
+		hs.Failures++
+	}
+	return healthy
+}
+
+// reset ... back to healthy with no fault injection (counters are kept)
+func (hs *HealthState) reset() {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.Healthy = true
+	hs.Flap = 0
+	hs.FailEvery = 0
+	hs.Sleep = ""
+}
+
+func isHealthCheck(r *http.Request) bool {
+	return strings.HasPrefix(r.UserAgent(), healthCheckerUA)
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if sleep := store.health.getClone().Sleep; sleep != "" {
+		time.Sleep(time.Duration(pickNumRange(sleep)) * time.Millisecond)
+	}
+	healthy := store.health.check()
+	hs := store.health.getClone()
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	s, _ := json.Marshal(struct {
+		Healthy bool        `json:"healthy"`
+		Host    HostInfo    `json:"host"`
+		State   HealthState `json:"state"`
+	}{healthy, store.host, hs})
+	fmt.Fprintf(w, "%s\n", string(s))
+}
+
+// applyHealth ... apply health actions of querystring
+func (qs *QueryString) applyHealth() {
+	switch qs.Health {
+	case "healthy":
+		store.health.setHealthy(true)
+	case "unhealthy":
+		store.health.setHealthy(false)
+	case "reset":
+		store.health.reset()
+	}
+	if qs.HealthFlap != "" {
+		sec, _ := strconv.ParseInt(qs.HealthFlap, 10, 64)
+		store.health.setFlap(sec)
+	}
+	if qs.HealthFailEvery != "" {
+		n, _ := strconv.ParseInt(qs.HealthFailEvery, 10, 64)
+		store.health.setFailEvery(n)
+	}
+	if qs.HealthSleep != "" {
+		if qs.HealthSleep == "0" {
+			store.health.setSleep("")
+		} else {
+			store.health.setSleep(qs.HealthSleep)
+		}
+	}
+}
+
+// pickNumRange ... "1000" or "1000-3000" (random value in range)
+func pickNumRange(value string) int64 {
+	nums := strings.SplitN(value, "-", 2)
+	min, _ := strconv.ParseInt(nums[0], 10, 64)
+	if len(nums) == 1 {
+		return min
+	}
+	max, _ := strconv.ParseInt(nums[1], 10, 64)
+	if max <= min {
+		return min
+	}
+	return min + rand.Int63n(max-min+1)
+}
@@ -1,42 +1,141 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/cgroup"
+	"github.com/miyaz/go-examples/internal/netaddr"
+	"github.com/miyaz/go-examples/internal/payload"
+	"github.com/miyaz/go-examples/internal/render"
+	"github.com/miyaz/go-examples/internal/sampler"
 )
 
 // DataStore ... Variables that use mutex
 type DataStore struct {
 	host      HostInfo
 	resource  ResourceInfo
+	health    *HealthState
+	defaults  *DefaultActions
+	rules     *RuleSet
+	scenario  *ScenarioRunner
+	proxy     *ProxyLog
+	cookies   *CookieCounter
+	conns     *ConnTable
 	validator map[string]*regexp.Regexp
 }
 
+func (ds *DataStore) getResourceInfo() ResourceInfo {
+	snap := procSampler.Snapshot()
+	info := ResourceInfo{
+		Scope:   ds.resource.Scope,
+		Host:    &ResourceView{CPU: snap.CPU.Usage, Memory: snap.Memory.UsedPercent, MemoryLimit: snap.Memory.Total},
+		LoadAvg: snap.LoadAvg,
+		Process: snap.Process,
+	}
+	if c := snap.Container; c != nil {
+		info.Container = &ResourceView{CPU: c.CPU, Memory: c.MemoryPercent, CPULimit: c.CPUQuota, MemoryLimit: c.MemoryLimit}
+	}
+	current := info.Host
+	if ds.resource.Scope == scopeContainer && info.Container != nil {
+		current = info.Container
+	}
+	info.CPU = ResourceUsage{Target: ds.resource.CPU.getTarget(), Current: current.CPU}
+	info.Memory = ResourceUsage{Target: ds.resource.Memory.getTarget(), Current: current.Memory}
+	info.IO = ds.resource.IO.getClone()
+	info.FDs = ds.resource.FDs.getClone()
+	info.Threads = ds.resource.Threads.getClone()
+	targets := ds.resource.coreTargets.get()
+	for i, core := range snap.Cores {
+		info.Cores = append(info.Cores, CoreUsage{Core: i, Target: targets[i], Current: core.Usage})
+	}
+	return info
+}
+
 // HostInfo ... information of host
+// IP は Addresses から -ip-family を優先して選んだ代表のアドレス
 type HostInfo struct {
-	Name string `json:"name"`
-	IP   string `json:"ip"`
-	AZ   string `json:"az,omitempty"`
+	Name      string            `json:"name"`
+	IP        string            `json:"ip"`
+	AZ        string            `json:"az,omitempty"`
+	Addresses []netaddr.Address `json:"addresses,omitempty"`
 }
 
 // ResourceInfo ... information of os resource
+// CPU/Memory の Current は Scope (host|container) 側の使用率
 type ResourceInfo struct {
-	CPU    ResourceUsage `json:"cpu"`
-	Memory ResourceUsage `json:"memory"`
+	Scope     string          `json:"scope"`
+	CPU       ResourceUsage   `json:"cpu"`
+	Memory    ResourceUsage   `json:"memory"`
+	Host      *ResourceView   `json:"host,omitempty"`
+	Container *ResourceView   `json:"container,omitempty"`
+	Cores     []CoreUsage     `json:"cores,omitempty"`
+	IO        ResourceUsage   `json:"io"`
+	FDs       ResourceUsage   `json:"fds"`
+	Threads   ResourceUsage   `json:"threads"`
+	LoadAvg   sampler.LoadAvg `json:"loadavg"`
+	Process   sampler.Process `json:"process"`
+
+	coreTargets *CoreTargets
+}
+
+// CoreUsage ... target and usage (percent) of one core
+type CoreUsage struct {
+	Core    int     `json:"core"`
+	Target  float64 `json:"target,omitempty"`
+	Current float64 `json:"current"`
+}
+
+// ResourceView ... usage (percent) and limits of host or container
+// CPULimit はコア数 (0 は制限なし)、MemoryLimit はバイト数 (0 は制限なし)
+type ResourceView struct {
+	CPU         float64 `json:"cpu"`
+	Memory      float64 `json:"memory"`
+	CPULimit    float64 `json:"cpulimit,omitempty"`
+	MemoryLimit uint64  `json:"memorylimit,omitempty"`
 }
 
 // ResourceUsage ... information of os resource usage
+// io は MiB/s、fds/threads は個数 (fds の Limit は RLIMIT_NOFILE)
 type ResourceUsage struct {
 	*sync.RWMutex
 	Target  float64 `json:"target"`
 	Current float64 `json:"current"`
+	Limit   float64 `json:"limit,omitempty"`
+}
+
+func newResourceUsage() ResourceUsage {
+	return ResourceUsage{RWMutex: &sync.RWMutex{}}
+}
+
+func (ru *ResourceUsage) getClone() ResourceUsage {
+	ru.RLock()
+	defer ru.RUnlock()
+	return ResourceUsage{Target: ru.Target, Current: ru.Current, Limit: ru.Limit}
+}
+func (ru *ResourceUsage) setCurrent(value float64) {
+	ru.Lock()
+	defer ru.Unlock()
+	ru.Current = value
+}
+func (ru *ResourceUsage) getLimit() float64 {
+	ru.RLock()
+	defer ru.RUnlock()
+	return ru.Limit
+}
+func (ru *ResourceUsage) setLimit(value float64) {
+	ru.Lock()
+	defer ru.Unlock()
+	ru.Limit = value
 }
 
 func (ru *ResourceUsage) getTarget() float64 {
@@ -51,80 +150,205 @@ func (ru *ResourceUsage) setTarget(value float64) {
 		ru.Target = value
 	}
 }
-func (ru *ResourceUsage) getCurrent() float64 {
-	ru.RLock()
-	defer ru.RUnlock()
-	return ru.Current
-}
-func (ru *ResourceUsage) setCurrent(value float64) {
-	if ru.getCurrent() != value {
-		ru.Lock()
-		defer ru.Unlock()
-		ru.Current = value
-	}
-}
 
 // RequestInfo ... information of request
 type RequestInfo struct {
-	Path     string            `json:"path"`
-	Query    string            `json:"querystring,omitempty"`
-	Header   map[string]string `json:"header"`
-	ClientIP string            `json:"clientip"`
-	Proxy1IP string            `json:"proxy1ip,omitempty"`
-	Proxy2IP string            `json:"proxy2ip,omitempty"`
-	TargetIP string            `json:"targetip"`
+	Path        string            `json:"path"`
+	Query       string            `json:"querystring,omitempty"`
+	Header      map[string]string `json:"header"`
+	ClientIP    string            `json:"clientip"`
+	Proxy1IP    string            `json:"proxy1ip,omitempty"`
+	Proxy2IP    string            `json:"proxy2ip,omitempty"`
+	TargetIP    string            `json:"targetip"`
+	TLS         *TLSInfo          `json:"tls,omitempty"`
+	TraceID     string            `json:"traceid"`
+	Hops        int               `json:"hops,omitempty"`
+	HeaderStats *HeaderStats      `json:"headerstats"`
+	Connection  *ConnInfo         `json:"connection,omitempty"`
 }
 
 // Direction ... information of directions
 type Direction struct {
 	Input  *QueryString `json:"input"`
 	Action *QueryString `json:"action"`
+	Rules  []Rule       `json:"rules,omitempty"`
 }
 
 // ResponseInfo ... information of response
 type ResponseInfo struct {
-	Host      HostInfo     `json:"host"`
-	Resource  ResourceInfo `json:"resource"`
-	Request   RequestInfo  `json:"request"`
-	Direction Direction    `json:"direction"`
+	Host       HostInfo         `json:"host"`
+	Resource   ResourceInfo     `json:"resource"`
+	Health     HealthState      `json:"health"`
+	Scenario   *ScenarioStatus  `json:"scenario,omitempty"`
+	Request    RequestInfo      `json:"request"`
+	Direction  Direction        `json:"direction"`
+	Upstreams  []UpstreamResult `json:"upstreams,omitempty"`
+	Dummy      string           `json:"dummy,omitempty"`
+	Seed       int64            `json:"seed,omitempty"`
+	Encoding   *EncodingInfo    `json:"encoding,omitempty"`
+	Stickiness *StickinessInfo  `json:"stickiness,omitempty"`
 }
 
 var store = &DataStore{
 	HostInfo{},
-	ResourceInfo{ResourceUsage{&sync.RWMutex{}, 0, 0}, ResourceUsage{&sync.RWMutex{}, 0, 0}},
+	ResourceInfo{
+		CPU:         newResourceUsage(),
+		Memory:      newResourceUsage(),
+		IO:          newResourceUsage(),
+		FDs:         newResourceUsage(),
+		Threads:     newResourceUsage(),
+		coreTargets: newCoreTargets(),
+	},
+	newHealthState(),
+	newDefaultActions(),
+	newRuleSet(),
+	newScenarioRunner(),
+	newProxyLog(),
+	newCookieCounter(),
+	newConnTable(),
 	newValidator(),
 }
 
 // QueryString ... QueryString Values
 type QueryString struct {
-	CPU          string `json:"cpu,omitempty"`
-	Memory       string `json:"memory,omitempty"`
-	Sleep        string `json:"sleep,omitempty"`
-	Size         string `json:"size,omitempty"`
-	Status       string `json:"status,omitempty"`
-	existsAction bool
-	needsAction  bool
-	IfClientIP   string `json:"ifclientip,omitempty"`
-	IfProxy1IP   string `json:"ifproxy1ip,omitempty"`
-	IfProxy2IP   string `json:"ifproxy2ip,omitempty"`
-	IfTargetIP   string `json:"iftargetip,omitempty"`
-	IfHostIP     string `json:"ifhostip,omitempty"`
-	IfHost       string `json:"ifhost,omitempty"`
-	IfAZ         string `json:"ifaz,omitempty"`
+	CPU             string `json:"cpu,omitempty"`
+	CPUCores        string `json:"cpucores,omitempty"`
+	CPUPerCore      string `json:"cpupercore,omitempty"`
+	Memory          string `json:"memory,omitempty"`
+	IO              string `json:"io,omitempty"`
+	FDs             string `json:"fds,omitempty"`
+	Threads         string `json:"threads,omitempty"`
+	Sleep           string `json:"sleep,omitempty"`
+	Size            string `json:"size,omitempty"`
+	Payload         string `json:"payload,omitempty"`
+	Seed            string `json:"seed,omitempty"`
+	Pattern         string `json:"pattern,omitempty"`
+	Encoding        string `json:"encoding,omitempty"`
+	ContentEncoding string `json:"contentencoding,omitempty"`
+	SetCookie       string `json:"setcookie,omitempty"`
+	CookieValue     string `json:"cookievalue,omitempty"`
+	CookieTTL       string `json:"cookiettl,omitempty"`
+	CookieAttrs     string `json:"cookieattrs,omitempty"`
+	Redirect        string `json:"redirect,omitempty"`
+	Location        string `json:"location,omitempty"`
+	Headers         string `json:"headers,omitempty"`
+	HeaderSize      string `json:"headersize,omitempty"`
+	LargeHeader     string `json:"largeheader,omitempty"`
+	Malformed       string `json:"malformed,omitempty"`
+	LimitHeader     string `json:"limitheader,omitempty"`
+	LimitURL        string `json:"limiturl,omitempty"`
+	Status          string `json:"status,omitempty"`
+	Upstream        string `json:"upstream,omitempty"`
+	UpstreamTimeout string `json:"upstreamtimeout,omitempty"`
+	UpstreamMode    string `json:"upstreammode,omitempty"`
+	AddHeaders      string `json:"addheaders,omitempty"`
+	ClearHeaders    string `json:"clearheaders,omitempty"`
+	Truncate        string `json:"truncate,omitempty"`
+	ProxyPhase      string `json:"proxyphase,omitempty"`
+	Health          string `json:"health,omitempty"`
+	HealthFlap      string `json:"healthflap,omitempty"`
+	HealthFailEvery string `json:"healthfailevery,omitempty"`
+	HealthSleep     string `json:"healthsleep,omitempty"`
+	Persist         string `json:"persist,omitempty"`
+	Unpersist       string `json:"unpersist,omitempty"`
+	existsAction    bool
+	needsAction     bool
+	values          map[string]string
+	IfClientIP      string `json:"ifclientip,omitempty"`
+	IfProxy1IP      string `json:"ifproxy1ip,omitempty"`
+	IfProxy2IP      string `json:"ifproxy2ip,omitempty"`
+	IfTargetIP      string `json:"iftargetip,omitempty"`
+	IfHostIP        string `json:"ifhostip,omitempty"`
+	IfHost          string `json:"ifhost,omitempty"`
+	IfAZ            string `json:"ifaz,omitempty"`
 }
 
 func (qs *QueryString) setValue(key, value string) {
+	if qs.values == nil {
+		qs.values = map[string]string{}
+	}
+	qs.values[key] = value
 	switch key {
 	case "cpu":
 		qs.CPU = value
+	case "cpucores":
+		qs.CPUCores = value
+	case "cpupercore":
+		qs.CPUPerCore = value
 	case "memory":
 		qs.Memory = value
+	case "io":
+		qs.IO = value
+	case "fds":
+		qs.FDs = value
+	case "threads":
+		qs.Threads = value
 	case "sleep":
 		qs.Sleep = value
 	case "size":
 		qs.Size = value
+	case "payload":
+		qs.Payload = value
+	case "seed":
+		qs.Seed = value
+	case "pattern":
+		qs.Pattern = value
+	case "encoding":
+		qs.Encoding = value
+	case "contentencoding":
+		qs.ContentEncoding = value
+	case "setcookie":
+		qs.SetCookie = value
+	case "cookievalue":
+		qs.CookieValue = value
+	case "cookiettl":
+		qs.CookieTTL = value
+	case "cookieattrs":
+		qs.CookieAttrs = value
+	case "redirect":
+		qs.Redirect = value
+	case "location":
+		qs.Location = value
+	case "headers":
+		qs.Headers = value
+	case "headersize":
+		qs.HeaderSize = value
+	case "largeheader":
+		qs.LargeHeader = value
+	case "malformed":
+		qs.Malformed = value
+	case "limitheader":
+		qs.LimitHeader = value
+	case "limiturl":
+		qs.LimitURL = value
 	case "status":
 		qs.Status = value
+	case "upstream":
+		qs.Upstream = value
+	case "upstreamtimeout":
+		qs.UpstreamTimeout = value
+	case "upstreammode":
+		qs.UpstreamMode = value
+	case "addheaders":
+		qs.AddHeaders = value
+	case "clearheaders":
+		qs.ClearHeaders = value
+	case "truncate":
+		qs.Truncate = value
+	case "proxyphase":
+		qs.ProxyPhase = value
+	case "health":
+		qs.Health = value
+	case "healthflap":
+		qs.HealthFlap = value
+	case "healthfailevery":
+		qs.HealthFailEvery = value
+	case "healthsleep":
+		qs.HealthSleep = value
+	case "persist":
+		qs.Persist = value
+	case "unpersist":
+		qs.Unpersist = value
 	case "ifclientip":
 		qs.IfClientIP = value
 	case "ifproxy1ip":
@@ -145,9 +369,29 @@ func (qs *QueryString) setValue(key, value string) {
 func newValidator() map[string]*regexp.Regexp {
 	const (
 		regexpPercent  = "^(100|[0-9]{1,2})$"
+		regexpNumber   = "^([0-9]+)$"
+		regexpCores    = "^([0-9]+:(?:100|[0-9]{1,2}))(?:,[0-9]+:(?:100|[0-9]{1,2}))*$"
 		regexpNumRange = "^([0-9]+)(?:-([0-9]+))?$"
+		regexpNumPct   = "^([0-9]+)(%)?$"
 		//regexpNumComma = "^([0-9]+)(?:,([0-9]+))*$" // 2個以上はFindStringSubmatchで取得不可のためmatchしたらstrings.Split
-		regexpStatus   = "^(200|400|403|404|500|502|503|504)$"
+		regexpStatus   = "^(200|400|403|404|414|431|500|502|503|504)$"
+		regexpHealth   = "^(healthy|unhealthy|reset)$"
+		regexpDuration = "^([0-9]+)(ms|s|m|h)?$"
+		regexpRuleID   = "^(r[0-9]+|all)$"
+		regexpURLs     = "^(https?://[^,\\s]+)(?:,https?://[^,\\s]+)*$"
+		regexpUpMode   = "^(sequential|parallel|first)$"
+		regexpNames    = "^([A-Za-z0-9-]+)(?:,[A-Za-z0-9-]+)*$"
+		regexpPhase    = "^(before|after)$"
+		regexpPayload  = "^(text|pattern|binary|zeros|json)$"
+		regexpPattern  = "^([ -~]{1,256})$"
+		regexpCodings  = "^((?:gzip|deflate|rawdeflate|br|identity)(?:,(?:gzip|deflate|rawdeflate|br|identity))*)$"
+		regexpCEHeader = "^(none|[a-z0-9-]+(?:,[a-z0-9-]+)*)$"
+		regexpToken    = "^([A-Za-z0-9!#$%&'*+.^_`|~-]{1,128})$"
+		regexpCValue   = "^([A-Za-z0-9!#$%&'()*+./:<=>?@\\[\\]^_`{|}~-]{1,256})$"
+		regexpCAttrs   = "^((?:secure|httponly|samesite-(?:lax|strict|none))(?:,(?:secure|httponly|samesite-(?:lax|strict|none)))*)$"
+		regexpRedirect = "^(301|302|307|308)$"
+		regexpLocation = "^([!-~]+)$"
+		regexpMalform  = "^((?:badname|obsfold|dupcl|badstatus|barelf)(?:,(?:badname|obsfold|dupcl|badstatus|barelf))*)$"
 		regexpHostname = "^([a-zA-Z0-9-.]+)$"
 		regexpAZone    = "^([a-z]{2}-[a-z]+-[1-9][a-d])$"
 		regexpIPv4     = "^((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?).){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)$"
@@ -155,10 +399,45 @@ func newValidator() map[string]*regexp.Regexp {
 	)
 	validator := map[string]*regexp.Regexp{}
 	validator["cpu"] = regexp.MustCompile(regexpPercent)
+	validator["cpucores"] = regexp.MustCompile(regexpNumber)
+	validator["cpupercore"] = regexp.MustCompile(regexpCores)
 	validator["memory"] = regexp.MustCompile(regexpPercent)
+	validator["io"] = regexp.MustCompile(regexpNumber)
+	validator["fds"] = regexp.MustCompile(regexpNumPct)
+	validator["threads"] = regexp.MustCompile(regexpNumber)
 	validator["sleep"] = regexp.MustCompile(regexpNumRange)
 	validator["size"] = regexp.MustCompile(regexpNumRange)
+	validator["payload"] = regexp.MustCompile(regexpPayload)
+	validator["seed"] = regexp.MustCompile(regexpNumber)
+	validator["pattern"] = regexp.MustCompile(regexpPattern)
+	validator["encoding"] = regexp.MustCompile(regexpCodings)
+	validator["contentencoding"] = regexp.MustCompile(regexpCEHeader)
+	validator["setcookie"] = regexp.MustCompile(regexpToken)
+	validator["cookievalue"] = regexp.MustCompile(regexpCValue)
+	validator["cookiettl"] = regexp.MustCompile(regexpNumber)
+	validator["cookieattrs"] = regexp.MustCompile(regexpCAttrs)
+	validator["redirect"] = regexp.MustCompile(regexpRedirect)
+	validator["location"] = regexp.MustCompile(regexpLocation)
+	validator["headers"] = regexp.MustCompile(regexpNumber)
+	validator["headersize"] = regexp.MustCompile(regexpNumber)
+	validator["largeheader"] = regexp.MustCompile(regexpNumber)
+	validator["malformed"] = regexp.MustCompile(regexpMalform)
+	validator["limitheader"] = regexp.MustCompile(regexpNumber)
+	validator["limiturl"] = regexp.MustCompile(regexpNumber)
 	validator["status"] = regexp.MustCompile(regexpStatus)
+	validator["upstream"] = regexp.MustCompile(regexpURLs)
+	validator["upstreamtimeout"] = regexp.MustCompile(regexpNumber)
+	validator["upstreammode"] = regexp.MustCompile(regexpUpMode)
+	validator["addheaders"] = regexp.MustCompile(regexpNames)
+	validator["clearheaders"] = regexp.MustCompile(regexpNames)
+	validator["truncate"] = regexp.MustCompile(regexpNumber)
+	validator["proxyphase"] = regexp.MustCompile(regexpPhase)
+	validator["health"] = regexp.MustCompile(regexpHealth)
+	validator["healthflap"] = regexp.MustCompile(regexpNumber)
+	validator["healthfailevery"] = regexp.MustCompile(regexpNumber)
+	validator["healthsleep"] = regexp.MustCompile(regexpNumRange)
+	validator["persist"] = regexp.MustCompile(regexpDuration)
+	validator["unpersist"] = regexp.MustCompile(regexpRuleID)
 	validator["ifhost"] = regexp.MustCompile(regexpHostname)
 	validator["ifaz"] = regexp.MustCompile(regexpAZone)
 	validator["ifhostip"] = regexp.MustCompile(fmt.Sprintf("(%s|%s)", regexpIPv4, regexpIPv6))
@@ -169,57 +448,247 @@ func newValidator() map[string]*regexp.Regexp {
 	return validator
 }
 
-func getIPAddress() string {
-	var currentIP string
-	addrs, err := net.InterfaceAddrs()
+func getIPAddresses() []netaddr.Address {
+	addrs, err := netaddr.Interfaces()
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				fmt.Println("Current IP address : ", ipnet.IP.String())
-				currentIP = ipnet.IP.String()
-			}
-		}
+	for _, addr := range addrs {
+		fmt.Printf("IP address : %s/%d (%s, %s, %s)\n", addr.IP, addr.Prefix, addr.Interface, addr.Family, addr.Scope)
 	}
-	return currentIP
+	return addrs
 }
 
+var listenPort int
+var tlsOption = &TLSOption{}
+var shutdownOption = &ShutdownOption{}
+var adminOption = &AdminOption{}
+var scenarioFile string
+var ipFamily string
+var resourceOption = &ResourceOption{}
+var stressOption = &StressOption{}
+var proxyOption = &ProxyOption{}
+var encodingOption = &EncodingOption{}
+var headerOption = &HeaderOption{}
+var connOption = &ConnOption{}
+var upstreamOption = &UpstreamOption{}
+var payloadOption = &PayloadOption{}
+var renderer = &render.Renderer{Title: "reqhandle"}
+
 func main() {
+	flag.IntVar(&listenPort, "port", 9000, "listen port")
+	flag.IntVar(&tlsOption.Port, "tls-port", 0, "tls listen port (0: disabled)")
+	flag.StringVar(&tlsOption.CertFiles, "tls-cert", "", "comma separated PEM certificate files (empty: self-signed)")
+	flag.StringVar(&tlsOption.KeyFiles, "tls-key", "", "comma separated PEM key files")
+	flag.StringVar(&tlsOption.MinVersion, "tls-min-version", "", "minimum tls version (1.0-1.3)")
+	flag.StringVar(&tlsOption.MaxVersion, "tls-max-version", "", "maximum tls version (1.0-1.3)")
+	flag.StringVar(&tlsOption.Ciphers, "tls-ciphers", "", "comma separated cipher suite names of TLS 1.0-1.2 (TLS 1.3 suites are always enabled)")
+	flag.StringVar(&tlsOption.ClientAuth, "tls-client-auth", "none", "client certificate mode (none|request|require)")
+	flag.StringVar(&tlsOption.Fault, "tls-fault", "none", "serve broken certificate (none|expired|wronghost)")
+	flag.StringVar(&shutdownOption.Mode, "shutdown-mode", "graceful", "behaviour on SIGTERM (graceful|abrupt)")
+	flag.IntVar(&shutdownOption.Delay, "shutdown-delay", 0, "seconds to keep serving after SIGTERM")
+	flag.IntVar(&shutdownOption.Timeout, "shutdown-timeout", 30, "seconds to wait for in-flight requests")
+	flag.StringVar(&adminOption.Addr, "admin-addr", "127.0.0.1:9001", "admin listen address (empty: disabled)")
+	flag.StringVar(&adminOption.Token, "admin-token", "", "bearer token required by admin api (empty: no auth)")
+	flag.StringVar(&scenarioFile, "scenario", "", "scenario file (yaml/json) to run at startup")
+	flag.StringVar(&resourceOption.Scope, "resource-scope", scopeHost, "what cpu/memory targets refer to (host|container)")
+	flag.StringVar(&resourceOption.CgroupRoot, "cgroup-root", cgroup.DefaultRoot, "mount point of cgroup filesystem")
+	flag.StringVar(&stressOption.ScratchDir, "scratch-dir", os.TempDir(), "directory of scratch file for io stressor")
+	flag.StringVar(&proxyOption.Origin, "origin", "", "origin url to forward requests to (empty: disabled)")
+	defaultFormat := flag.String("format", string(render.Pretty), "response format without format= or Accept (json|pretty|yaml|text|html)")
+	flag.IntVar(&renderer.Refresh, "refresh", 2, "auto refresh seconds of html response (0: disabled)")
+	flag.BoolVar(&encodingOption.Compress, "compress", true, "compress response negotiated from Accept-Encoding (gzip|deflate|br)")
+	flag.IntVar(&headerOption.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "max bytes of request line and headers (exceeding: 431)")
+	flag.StringVar(&ipFamily, "ip-family", netaddr.IPv4, "address family preferred for host ip (ipv4|ipv6)")
+	flag.IntVar(&connOption.IdleTimeout, "idle-timeout", 65, "seconds to keep idle keep-alive connection (longer than idle timeout of load balancer)")
+	flag.IntVar(&payloadOption.MaxSize, "max-size", 10<<20, "max bytes of size= (larger values are clamped)")
+	flag.StringVar(&upstreamOption.Allow, "upstream-allow", "", "comma separated hosts (*.example.com, *) and CIDRs upstream= may call (empty: upstream disabled)")
+	flag.Parse()
+	if resourceOption.Scope != scopeHost && resourceOption.Scope != scopeContainer {
+		log.Fatalf("invalid resource-scope: %s\n", resourceOption.Scope)
+	}
+	if ipFamily != netaddr.IPv4 && ipFamily != netaddr.IPv6 {
+		log.Fatalf("invalid ip-family: %s\n", ipFamily)
+	}
+	allowlist, err := newUpstreamAllowlist(upstreamOption.Allow)
+	if err != nil {
+		log.Fatalf("invalid upstream-allow: %v\n", err)
+	}
+	upstreamAllowlist = allowlist
+	if format, ok := render.ParseFormat(*defaultFormat); ok {
+		renderer.Default = format
+	} else {
+		log.Fatalf("invalid format: %s\n", *defaultFormat)
+	}
+
 	fmt.Printf("%v\n", store)
 	store.host.Name, _ = os.Hostname()
-	store.host.IP = getIPAddress()
+	store.host.Addresses = getIPAddresses()
+	store.host.IP = netaddr.Primary(store.host.Addresses, ipFamily)
+	fmt.Println("Current IP address : ", store.host.IP)
 	http.HandleFunc("/", handler)
-	srv := &http.Server{Addr: ":9000"}
-	log.Fatalln(srv.ListenAndServe())
+	http.HandleFunc("/health", healthHandler)
+	resourceController(resourceOption)
+	stressController(stressOption)
+	if proxyOption.Origin != "" {
+		proxy, err := newReverseProxy(proxyOption)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		reverseProxy = proxy
+		fmt.Println("Origin : ", proxyOption.Origin)
+	}
+	if scenarioFile != "" {
+		scenario, err := loadScenarioFile(scenarioFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		store.scenario.start(scenario)
+	}
+
+	srv := &http.Server{
+		Addr:           ":" + strconv.Itoa(listenPort),
+		Handler:        withHeaderCapture(withDraining(withConnTracking(http.DefaultServeMux))),
+		MaxHeaderBytes: headerOption.MaxHeaderBytes,
+		IdleTimeout:    time.Duration(connOption.IdleTimeout) * time.Second,
+		ConnState:      store.conns.setState,
+		ConnContext:    withCaptureConn,
+	}
+	servers := []*http.Server{srv}
+	if tlsOption.Port != 0 {
+		tlsSrv, err := newTLSServer(tlsOption)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tlsSrv.Handler = srv.Handler
+		tlsSrv.MaxHeaderBytes = srv.MaxHeaderBytes
+		tlsSrv.IdleTimeout = srv.IdleTimeout
+		tlsSrv.ConnState = srv.ConnState
+		tlsSrv.ConnContext = srv.ConnContext
+		servers = append(servers, tlsSrv)
+		fmt.Println("TLS Listen Port : ", tlsOption.Port)
+		tlsLn, err := net.Listen("tcp", tlsSrv.Addr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			if err := tlsSrv.ServeTLS(&trackListener{tlsLn}, "", ""); err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
+	}
+	if adminOption.Addr != "" {
+		adminSrv := newAdminServer(adminOption)
+		servers = append(servers, adminSrv)
+		fmt.Println("Admin Listen Address : ", adminOption.Addr)
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
+	}
+	fmt.Println("Listen Port : ", listenPort)
+	// 受信したままのヘッダを取得するため平文のリスナは接続をラップする
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		if err := srv.Serve(&captureListener{&trackListener{ln}, srv.MaxHeaderBytes + captureMargin}); err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+	waitShutdown(shutdownOption, servers)
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	// ヘルスチェックはパスに関わらず health サブシステムで応答する
+	if isHealthCheck(r) {
+		healthHandler(w, r)
+		return
+	}
+	store.health.countRequest()
 	//w.WriteHeader(http.StatusNotFound)
 	reqInfo := RequestInfo{
-		Path:   r.URL.EscapedPath(),
-		Query:  r.URL.Query().Encode(),
-		Header: combineValues(r.Header),
+		Path:        r.URL.EscapedPath(),
+		Query:       r.URL.Query().Encode(),
+		Header:      combineValues(r.Header),
+		TLS:         newTLSInfo(r.TLS),
+		TraceID:     traceID(r),
+		Hops:        requestHops(r),
+		HeaderStats: requestHeaderStats(r),
+		Connection:  requestConn(r),
 	}
 	reqInfo.setIPAddresse(r)
 	respInfo := ResponseInfo{
-		Host: store.host,
-		Resource: ResourceInfo{
-			CPU:    ResourceUsage{Target: store.resource.CPU.getTarget(), Current: store.resource.CPU.getCurrent()},
-			Memory: ResourceUsage{Target: store.resource.Memory.getTarget(), Current: store.resource.Memory.getCurrent()},
-		},
+		Host:      store.host,
 		Request:   reqInfo,
 		Direction: Direction{},
 	}
 
 	inputQs := reqInfo.validateQueryString(r.URL.Query())
-	actionQs := inputQs.evaluate(&reqInfo)
+	inputQs.applyPersist(&reqInfo)
+	actionQs := inputQs.evaluate(&reqInfo).withDefaults(store.rules.resolve(&reqInfo, defaultActions()))
+	actionQs.applyHealth()
+	// リバースプロキシモードではオリジンの応答をそのまま返す
+	if reverseProxy != nil {
+		serveProxy(w, r, &reqInfo, actionQs)
+		return
+	}
+	status := actionQs.execute(&respInfo)
+	respInfo.Stickiness = actionQs.applyStickiness(r, &reqInfo, w.Header())
+	if redirect := actionQs.applyRedirect(r, &reqInfo, w.Header()); redirect != 0 {
+		status = redirect
+	}
+	if limit := actionQs.applyLimits(&reqInfo); limit != 0 {
+		status = limit
+	}
+	respInfo.Resource = store.getResourceInfo()
+	respInfo.Health = store.health.getClone()
+	respInfo.Scenario = store.scenario.getStatus()
 	respInfo.Direction.Input = inputQs
 	respInfo.Direction.Action = actionQs
-	s, _ := json.MarshalIndent(respInfo, "", "  ")
-	fmt.Fprintf(w, "\n%s\n", string(s))
+	respInfo.Direction.Rules = store.rules.list()
+	codings := actionQs.contentCodings(r, w.Header())
+	encodingHeader := actionQs.contentEncodingHeader(codings)
+	var body, encoded []byte
+	var contentType string
+	var err error
+	if actionQs.Payload != "" {
+		var gen *payload.Generator
+		body, gen = actionQs.generatePayload()
+		contentType = gen.Mode.ContentType()
+		encoded, err = compress(body, codings)
+		w.Header().Set(payload.SeedHeader, gen.SeedString())
+	} else {
+		body, encoded, contentType, err = encodeResponse(r, &respInfo, codings, encodingHeader)
+		if respInfo.Seed != 0 {
+			w.Header().Set(payload.SeedHeader, strconv.FormatInt(respInfo.Seed, 10))
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 本文の破損や欠落をクライアント側で検出できるようにチェックサムを付与する(圧縮前の本文が対象)
+	w.Header().Set(payload.ChecksumHeader, payload.Checksum(body))
+	if encodingHeader != "" {
+		w.Header().Set("Content-Encoding", encodingHeader)
+	}
+	if len(codings) > 0 {
+		w.Header().Set(originalSizeHeader, strconv.Itoa(len(body)))
+		w.Header().Set(encodedSizeHeader, strconv.Itoa(len(encoded)))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	actionQs.applyPadHeaders(w.Header())
+	actionQs.applyHeaders(w.Header())
+	if actionQs.Malformed != "" {
+		if err := writeMalformed(w, status, contentType, encoded, splitNames(actionQs.Malformed)); err != nil {
+			fmt.Printf("failed to write malformed response: %v\n", err)
+		}
+		return
+	}
+	render.Write(w, status, contentType, encoded)
 }
 
 func (reqInfo *RequestInfo) validateQueryString(mapQs map[string][]string) *QueryString {
@@ -229,7 +698,7 @@ func (reqInfo *RequestInfo) validateQueryString(mapQs map[string][]string) *Quer
 			if len(re.FindStringSubmatch(value)) > 0 {
 				qs.setValue(key, value)
 				if strings.HasPrefix(key, "if") {
-					if reqInfo.getActualValue(key) != value {
+					if !reqInfo.matchesValue(key, value) {
 						qs.needsAction = false
 					}
 				} else {
@@ -241,6 +710,12 @@ func (reqInfo *RequestInfo) validateQueryString(mapQs map[string][]string) *Quer
 			}
 		}
 	}
+	// addheaders で指定されたヘッダの値を保持する(persist 等で引き継ぐため values に含める)
+	for name := range splitNames(qs.AddHeaders) {
+		if values, ok := mapQs[name]; ok {
+			qs.values[name] = strings.Join(values, ", ")
+		}
+	}
 	return qs
 }
 
@@ -252,11 +727,12 @@ func combineValues(input map[string][]string) map[string]string {
 	return output
 }
 
+// setIPAddresse ... client/proxy/target address of request (IPv6 は正規化しゾーン ID を残す)
 func (reqInfo *RequestInfo) setIPAddresse(r *http.Request) {
-	reqInfo.TargetIP = extractIPAddress(r.Host)
-	xff := splitXFF(r.Header.Get("X-Forwarded-For"))
+	reqInfo.TargetIP = netaddr.Host(r.Host)
+	xff := netaddr.SplitXFF(r.Header.Values("X-Forwarded-For")...)
 	if len(xff) == 0 {
-		reqInfo.ClientIP = extractIPAddress(r.RemoteAddr)
+		reqInfo.ClientIP = netaddr.Host(r.RemoteAddr)
 	} else {
 		reqInfo.ClientIP = xff[0]
 	}
@@ -268,28 +744,6 @@ func (reqInfo *RequestInfo) setIPAddresse(r *http.Request) {
 	}
 }
 
-func extractIPAddress(ipport string) string {
-	var ipaddr string
-	if strings.HasPrefix(ipport, "[") {
-		ipaddr = strings.Join(strings.Split(ipport, ":")[:len(strings.Split(ipport, ":"))-1], ":")
-		ipaddr = strings.Trim(ipaddr, "[]")
-	} else {
-		ipaddr = strings.Split(ipport, ":")[0]
-	}
-	return ipaddr
-}
-
-func splitXFF(xffStr string) []string {
-	if xffStr == "" {
-		return []string{}
-	}
-	xff := strings.Split(xffStr, ",")
-	for i := range xff {
-		xff[i] = strings.TrimSpace(xff[i])
-	}
-	return xff
-}
-
 func (qs *QueryString) evaluate(reqInfo *RequestInfo) *QueryString {
 	actionQs := &QueryString{}
 	if !qs.existsAction {
@@ -322,3 +776,20 @@ func (reqInfo *RequestInfo) getActualValue(key string) (ret string) {
 	}
 	return
 }
+
+// matchesValue ... whether actual value of key is value (アドレスは表記の違いを無視して比較する)
+// ifhostip はデュアルスタックのホストでどちらのアドレスでも一致するよう全てのアドレスと比較する
+func (reqInfo *RequestInfo) matchesValue(key, value string) bool {
+	if key == "ifhostip" {
+		for _, addr := range store.host.Addresses {
+			if netaddr.Equal(addr.IP, value) {
+				return true
+			}
+		}
+	}
+	actual := reqInfo.getActualValue(key)
+	if strings.HasSuffix(key, "ip") {
+		return netaddr.Equal(actual, value)
+	}
+	return actual == value
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/payload"
+)
+
+// kinds of malformed response (written through hijacked connection)
+const (
+	malformedBadName   = "badname"   // header name with space and control character
+	malformedObsFold   = "obsfold"   // obs-fold continuation line
+	malformedDupCL     = "dupcl"     // duplicate Content-Length with different values
+	malformedBadStatus = "badstatus" // invalid status line
+	malformedBareLF    = "barelf"    // LF instead of CRLF
+)
+
+// ヘッダを大量に付与する場合の上限
+const (
+	maxPadHeaders     = 10000
+	maxPadHeaderSize  = 1 << 20
+	maxLargeHeaderLen = 64 << 20
+)
+
+// applyPadHeaders ... add headers=N of headersize=M bytes and a largeheader=N bytes header
+func (qs *QueryString) applyPadHeaders(h http.Header) {
+	gen := payload.New(payload.Option{Mode: payload.Text, Seed: 1})
+	if qs.Headers != "" {
+		n, _ := strconv.Atoi(qs.Headers)
+		size, _ := strconv.Atoi(qs.HeaderSize)
+		if n > maxPadHeaders {
+			n = maxPadHeaders
+		}
+		if size > maxPadHeaderSize {
+			size = maxPadHeaderSize
+		}
+		value := string(gen.Generate(size))
+		for i := 1; i <= n; i++ {
+			h.Set(fmt.Sprintf("X-Pad-%04d", i), value)
+		}
+	}
+	if qs.LargeHeader != "" {
+		size, _ := strconv.Atoi(qs.LargeHeader)
+		if size > maxLargeHeaderLen {
+			size = maxLargeHeaderLen
+		}
+		h.Set("X-Large-Header", string(gen.Generate(size)))
+	}
+}
+
+// writeMalformed ... write response which violates HTTP/1.1 through hijacked connection
+// net/http の ResponseWriter では不正な応答を書けないため、接続を奪って直接書き込み、最後に切断する
+func writeMalformed(w http.ResponseWriter, status int, contentType string, body []byte, kinds map[string]bool) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "malformed response is not supported on this connection (HTTP/2)", http.StatusInternalServerError)
+		return fmt.Errorf("hijack is not supported")
+	}
+	h := w.Header().Clone()
+	if _, ok := h["Content-Type"]; !ok {
+		h.Set("Content-Type", contentType)
+	}
+	if _, ok := h["Date"]; !ok {
+		h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	h.Del("Content-Length")
+	h.Set("Connection", "close")
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	eol := "\r\n"
+	if kinds[malformedBareLF] {
+		eol = "\n"
+	}
+	if kinds[malformedBadStatus] {
+		fmt.Fprintf(rw, "HTTP/1.1 %dx Invalid Status%s", status, eol)
+	} else {
+		fmt.Fprintf(rw, "HTTP/1.1 %d %s%s", status, http.StatusText(status), eol)
+	}
+	writeRawHeaders(rw.Writer, h, eol)
+	fmt.Fprintf(rw, "Content-Length: %d%s", len(body), eol)
+	if kinds[malformedDupCL] {
+		fmt.Fprintf(rw, "Content-Length: %d%s", len(body)+1, eol)
+	}
+	if kinds[malformedBadName] {
+		fmt.Fprintf(rw, "X Bad Header: space in name%s", eol)
+		fmt.Fprintf(rw, "X-Bad\x01Header: control character in name%s", eol)
+	}
+	if kinds[malformedObsFold] {
+		fmt.Fprintf(rw, "X-Folded: first line%s continued line%s", eol, eol)
+	}
+	fmt.Fprint(rw, eol)
+	rw.Write(body)
+	return rw.Flush()
+}
+
+func writeRawHeaders(w *bufio.Writer, h http.Header, eol string) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			fmt.Fprintf(w, "%s: %s%s", name, value, eol)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricWriter ... writer of prometheus text exposition format
+type metricWriter struct {
+	buf  *bytes.Buffer
+	seen map[string]bool
+}
+
+// gauge ... write HELP/TYPE (first time only) and one sample
+func (mw *metricWriter) gauge(name, help string, value float64, labels map[string]string) {
+	if !mw.seen[name] {
+		fmt.Fprintf(mw.buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		mw.seen[name] = true
+	}
+	pairs := []string{}
+	for key, v := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, labelEscaper.Replace(v)))
+	}
+	sort.Strings(pairs)
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(mw.buf, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// adminMetricsHandler ... resource targets and scenario progress in prometheus text format
+// シナリオ実行中は reqhandle_scenario_step に現在のステップをラベルとして出力する
+func adminMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	mw := &metricWriter{&bytes.Buffer{}, map[string]bool{}}
+	info := store.getResourceInfo()
+	mw.gauge("reqhandle_cpu_target_percent", "cpu usage target", info.CPU.Target, nil)
+	mw.gauge("reqhandle_cpu_usage_percent", "cpu usage of resource scope", info.CPU.Current, nil)
+	mw.gauge("reqhandle_memory_target_percent", "memory usage target", info.Memory.Target, nil)
+	mw.gauge("reqhandle_memory_usage_percent", "memory usage of resource scope", info.Memory.Current, nil)
+	healthy := 0.0
+	if store.health.getClone().Healthy {
+		healthy = 1
+	}
+	mw.gauge("reqhandle_healthy", "health state set by health actions (1: healthy)", healthy, nil)
+
+	running := 0.0
+	if status := store.scenario.getStatus(); status != nil {
+		labels := map[string]string{"scenario": status.Name}
+		if status.Running {
+			running = 1
+			mw.gauge("reqhandle_scenario_step", "current step of running scenario", 1, map[string]string{
+				"scenario": status.Name,
+				"step":     status.Step,
+				"index":    strconv.Itoa(status.StepIndex),
+			})
+		}
+		mw.gauge("reqhandle_scenario_running", "whether scenario is running (1: running)", running, labels)
+		mw.gauge("reqhandle_scenario_iteration", "iteration of scenario", float64(status.Iteration), labels)
+		mw.gauge("reqhandle_scenario_step_index", "index of current step", float64(status.StepIndex), labels)
+		mw.gauge("reqhandle_scenario_step_repeat", "repeat count of current step", float64(status.StepRepeat), labels)
+		mw.gauge("reqhandle_scenario_step_started_seconds", "unix time when current step started", float64(status.StepStartedAt.UnixNano())/1e9, labels)
+	} else {
+		mw.gauge("reqhandle_scenario_running", "whether scenario is running (1: running)", running, nil)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(mw.buf.Bytes())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const proxyLogSize = 100
+
+// proxy phases (when sleep is applied)
+// cpu 等の負荷は常に転送前、status/addheaders/clearheaders/truncate は常にオリジンの応答に適用する
+const (
+	proxyBefore = "before"
+	proxyAfter  = "after"
+)
+
+// proxyActions ... parameters consumed by this node in reverse-proxy mode (removed from forwarded query)
+// size/location/encoding 等このモードで使わないパラメータはオリジンのアプリが使うかもしれないのでそのまま転送する
+var proxyActions = map[string]bool{
+	"cpu": true, "cpucores": true, "cpupercore": true, "memory": true, "io": true, "fds": true, "threads": true,
+	"sleep": true, "proxyphase": true,
+	"status": true, "addheaders": true, "clearheaders": true, "truncate": true,
+	"health": true, "healthflap": true, "healthfailevery": true, "healthsleep": true,
+	"persist": true, "unpersist": true,
+	"ifhost": true, "ifaz": true, "ifhostip": true, "iftargetip": true, "ifproxy1ip": true, "ifproxy2ip": true, "ifclientip": true,
+}
+
+// ProxyOption ... settings of reverse-proxy mode
+type ProxyOption struct {
+	Origin string
+}
+
+// ProxyRecord ... one request forwarded to origin
+type ProxyRecord struct {
+	Time         time.Time    `json:"time"`
+	Request      RequestInfo  `json:"request"`
+	Action       *QueryString `json:"action"`
+	Forwarded    string       `json:"forwarded"`
+	OriginStatus int          `json:"originstatus,omitempty"`
+	Status       int          `json:"status"`
+	Timings      ProxyTimings `json:"timings"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// ProxyTimings ... elapsed time (milliseconds)
+// Origin はオリジンへの送信から応答ヘッダ受信まで、Added は sleep で付加した時間
+type ProxyTimings struct {
+	Total  float64 `json:"total"`
+	Origin float64 `json:"origin"`
+	Added  float64 `json:"added"`
+}
+
+// ProxyLog ... recent records of reverse-proxy mode
+type ProxyLog struct {
+	*sync.RWMutex
+	records []ProxyRecord
+}
+
+func newProxyLog() *ProxyLog {
+	return &ProxyLog{RWMutex: &sync.RWMutex{}}
+}
+
+func (pl *ProxyLog) add(record ProxyRecord) {
+	pl.Lock()
+	defer pl.Unlock()
+	pl.records = append(pl.records, record)
+	if len(pl.records) > proxyLogSize {
+		pl.records = pl.records[len(pl.records)-proxyLogSize:]
+	}
+}
+func (pl *ProxyLog) list() []ProxyRecord {
+	pl.RLock()
+	defer pl.RUnlock()
+	records := make([]ProxyRecord, len(pl.records))
+	copy(records, pl.records)
+	return records
+}
+func (pl *ProxyLog) clear() {
+	pl.Lock()
+	defer pl.Unlock()
+	pl.records = nil
+}
+
+type proxyContextKey struct{}
+
+// proxyExchange ... state of one request shared with ReverseProxy callbacks
+type proxyExchange struct {
+	qs          *QueryString
+	record      *ProxyRecord
+	originStart time.Time
+}
+
+var reverseProxy *httputil.ReverseProxy
+
+// newReverseProxy ... ReverseProxy to origin which applies actions to the response
+func newReverseProxy(opt *ProxyOption) (*httputil.ReverseProxy, error) {
+	origin, err := url.Parse(opt.Origin)
+	if err != nil {
+		return nil, err
+	}
+	if origin.Scheme != "http" && origin.Scheme != "https" {
+		return nil, fmt.Errorf("origin must be http(s) url: %s", opt.Origin)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(origin)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		ex := req.Context().Value(proxyContextKey{}).(*proxyExchange)
+		req.Header.Set(traceIDHeader, ex.record.Request.TraceID)
+		ex.record.Forwarded = req.URL.String()
+		ex.originStart = time.Now()
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		ex := resp.Request.Context().Value(proxyContextKey{}).(*proxyExchange)
+		ex.record.Timings.Origin = msSince(ex.originStart)
+		ex.record.OriginStatus = resp.StatusCode
+		if ex.qs.ProxyPhase == proxyAfter {
+			ex.record.Timings.Added += ex.qs.sleep()
+		}
+		if ex.qs.Status != "" {
+			resp.StatusCode, _ = strconv.Atoi(ex.qs.Status)
+			resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		ex.qs.applyHeaders(resp.Header)
+		if ex.qs.Truncate != "" {
+			n, _ := strconv.ParseInt(ex.qs.Truncate, 10, 64)
+			if resp.ContentLength < 0 || n < resp.ContentLength {
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.LimitReader(resp.Body, n), resp.Body}
+				resp.ContentLength = -1
+				resp.Header.Del("Content-Length")
+			}
+		}
+		ex.record.Status = resp.StatusCode
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		ex := r.Context().Value(proxyContextKey{}).(*proxyExchange)
+		ex.record.Error = err.Error()
+		ex.record.Status = http.StatusBadGateway
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy, nil
+}
+
+// serveProxy ... forward request to origin without parameters consumed by this node
+func serveProxy(w http.ResponseWriter, r *http.Request, reqInfo *RequestInfo, qs *QueryString) {
+	start := time.Now()
+	record := &ProxyRecord{Time: start, Request: *reqInfo, Action: qs}
+	qs.applyResource()
+	if qs.ProxyPhase != proxyAfter {
+		record.Timings.Added += qs.sleep()
+	}
+
+	query := r.URL.Query()
+	headerParams := splitNames(query.Get("addheaders"))
+	for key := range query {
+		if proxyActions[key] || headerParams[key] {
+			query.Del(key)
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+
+	ex := &proxyExchange{qs: qs, record: record}
+	if qs.ClearHeaders != "" {
+		w = &clearHeaderWriter{w, qs}
+	}
+	reverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, ex)))
+	record.Timings.Total = msSince(start)
+	store.proxy.add(*record)
+	fmt.Printf("proxy %s -> %d (origin %d, %.1fms) %s\n", record.Forwarded, record.Status, record.OriginStatus, record.Timings.Total, record.Error)
+}
+
+// clearHeaderWriter ... suppress headers which server adds (Date/Content-Type) after ReverseProxy copied the response
+type clearHeaderWriter struct {
+	http.ResponseWriter
+	qs *QueryString
+}
+
+func (w *clearHeaderWriter) WriteHeader(status int) {
+	for name := range splitNames(w.qs.ClearHeaders) {
+		w.Header()[http.CanonicalHeaderKey(name)] = nil
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *clearHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/cpuload"
+	"github.com/miyaz/go-examples/internal/sampler"
+)
+
+const statInterval = 500
+const memChunkSize = 1 << 20
+const corePeriod = 100 // 1 コアあたりの負荷の周期(ミリ秒)
+
+// resource scopes (what cpu/memory targets refer to)
+const (
+	scopeHost      = "host"
+	scopeContainer = "container"
+)
+
+// procSampler ... created by resourceController before any request is served
+var procSampler *sampler.Sampler
+
+// ResourceOption ... settings of resource accounting
+type ResourceOption struct {
+	Scope      string
+	CgroupRoot string
+}
+
+// resourceController ... keep cpu/memory usage close to the target of store
+func resourceController(opt *ResourceOption) {
+	procSampler = sampler.New(sampler.Option{Interval: statInterval * time.Millisecond, Cgroup: true, CgroupRoot: opt.CgroupRoot})
+	if opt.Scope == scopeContainer && procSampler.CgroupVersion() == 0 {
+		// cgroup が見つからない場合はホスト全体を対象にする
+		fmt.Println("cgroup not found, resource scope falls back to host")
+		opt.Scope = scopeHost
+	}
+	store.resource.Scope = opt.Scope
+	fmt.Printf("Resource Scope : %s (cgroup v%d)\n", opt.Scope, procSampler.CgroupVersion())
+	procSampler.Start()
+	go cpuController()
+	go coreController()
+	go memController()
+}
+
+// cpuController ... adjust interval of load placement until usage reaches the target
+func cpuController() {
+	cpuload.Run(store.resource.CPU.getTarget, func() float64 {
+		cpu, _, _ := currentUsage(procSampler.Snapshot())
+		return cpu
+	})
+}
+
+// CoreTargets ... cpu usage targets of individual cores (core number -> percent)
+type CoreTargets struct {
+	*sync.RWMutex
+	targets map[int]float64
+}
+
+func newCoreTargets() *CoreTargets {
+	return &CoreTargets{&sync.RWMutex{}, map[int]float64{}}
+}
+
+func (ct *CoreTargets) get() map[int]float64 {
+	ct.RLock()
+	defer ct.RUnlock()
+	targets := map[int]float64{}
+	for core, target := range ct.targets {
+		targets[core] = target
+	}
+	return targets
+}
+func (ct *CoreTargets) set(targets map[int]float64) {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.targets = map[int]float64{}
+	for core, target := range targets {
+		if target > 0 {
+			ct.targets[core] = target
+		}
+	}
+}
+
+// parseCoreTargets ... "0:90,3:50" to core targets
+func parseCoreTargets(value string) map[int]float64 {
+	targets := map[int]float64{}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		core, err := strconv.Atoi(kv[0])
+		if err != nil || runtime.NumCPU() <= core {
+			fmt.Printf("core %s is out of range (0-%d)\n", kv[0], runtime.NumCPU()-1)
+			continue
+		}
+		targets[core], _ = strconv.ParseFloat(kv[1], 64)
+	}
+	return targets
+}
+
+// coreController ... keep usage of each targeted core close to its target
+// コアごとに OS スレッドを固定した goroutine を 1 つ起動し、duty (周期内で負荷をかける割合) を調整する
+func coreController() {
+	type worker struct {
+		duty float64
+		ch   chan float64
+	}
+	workers := map[int]*worker{}
+	t := time.NewTicker(time.Duration(statInterval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		<-t.C
+		targets := store.resource.coreTargets.get()
+		for core, w := range workers {
+			if _, ok := targets[core]; !ok {
+				close(w.ch)
+				delete(workers, core)
+			}
+		}
+		cores := procSampler.Snapshot().Cores
+		for core, target := range targets {
+			w, ok := workers[core]
+			if !ok {
+				w = &worker{duty: target / 100, ch: make(chan float64, 1)}
+				workers[core] = w
+				go coreLoad(core, w.duty, w.ch)
+				continue
+			}
+			if core >= len(cores) {
+				continue
+			}
+			w.duty += (target - cores[core].Usage) / 100 / 2
+			if w.duty < 0 {
+				w.duty = 0
+			} else if w.duty > 1 {
+				w.duty = 1
+			}
+			select {
+			case w.ch <- w.duty:
+			default:
+			}
+		}
+	}
+}
+
+// coreLoad ... busy loop for duty of every period on the core until ch is closed
+func coreLoad(core int, duty float64, ch chan float64) {
+	// affinity を変更したスレッドが他の goroutine に使い回されないよう Unlock せずに終了させてスレッドごと破棄する
+	runtime.LockOSThread()
+	if err := pinCurrentThread(core); err != nil {
+		fmt.Printf("failed to pin core %d: %v\n", core, err)
+	}
+	period := time.Duration(corePeriod) * time.Millisecond
+	for {
+		select {
+		case d, ok := <-ch:
+			if !ok {
+				return
+			}
+			duty = d
+		default:
+		}
+		start := time.Now()
+		busy := time.Duration(float64(period) * duty)
+		for time.Since(start) < busy {
+		}
+		time.Sleep(period - busy)
+	}
+}
+
+// currentUsage ... cpu usage (percent) and memory used/total (bytes) of the resource scope
+// コンテナのメモリ制限がない場合はホストの MemTotal を上限とする
+func currentUsage(snap *sampler.Snapshot) (cpu float64, used, total uint64) {
+	if c := snap.Container; store.resource.Scope == scopeContainer && c != nil {
+		total = c.MemoryLimit
+		if total == 0 || total > snap.Memory.Total {
+			total = snap.Memory.Total
+		}
+		return c.CPU, c.Memory, total
+	}
+	return snap.CPU.Usage, snap.Memory.Used, snap.Memory.Total
+}
+
+// memController ... hold heap memory until usage reaches the target
+func memController() {
+	var chunks [][]byte
+	t := time.NewTicker(time.Duration(statInterval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		<-t.C
+		target := store.resource.Memory.getTarget()
+		if target == 0 {
+			if len(chunks) > 0 {
+				chunks = nil
+				debug.FreeOSMemory()
+			}
+			continue
+		}
+		_, used, total := currentUsage(procSampler.Snapshot())
+		if total == 0 {
+			continue
+		}
+		diff := int((float64(total)*target/100 - float64(used)) / memChunkSize)
+		switch {
+		case diff > 0:
+			for i := 0; i < diff; i++ {
+				chunk := make([]byte, memChunkSize)
+				// 実メモリを割り当てるためにページに書き込む
+				for j := 0; j < len(chunk); j += os.Getpagesize() {
+					chunk[j] = 1
+				}
+				chunks = append(chunks, chunk)
+			}
+		case diff < 0 && len(chunks) > 0:
+			release := -diff
+			if release > len(chunks) {
+				release = len(chunks)
+			}
+			for i := len(chunks) - release; i < len(chunks); i++ {
+				chunks[i] = nil
+			}
+			chunks = chunks[:len(chunks)-release]
+			debug.FreeOSMemory()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule ... actions persisted by persist= and applied to subsequent requests
+type Rule struct {
+	ID         string            `json:"id"`
+	Actions    map[string]string `json:"actions"`
+	Conditions map[string]string `json:"conditions,omitempty"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+}
+
+// RuleSet ... persisted rules of this node
+type RuleSet struct {
+	*sync.RWMutex
+	seq   int64
+	rules []*Rule
+}
+
+func newRuleSet() *RuleSet {
+	return &RuleSet{RWMutex: &sync.RWMutex{}}
+}
+
+// add ... register rule, actions overwrite those of older rules when both match
+func (rs *RuleSet) add(actions, conditions map[string]string, ttl time.Duration) Rule {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.seq++
+	rule := &Rule{
+		ID:         "r" + strconv.FormatInt(rs.seq, 10),
+		Actions:    actions,
+		Conditions: conditions,
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	rs.rules = append(rs.rules, rule)
+	return *rule
+}
+
+// remove ... delete rule by id ("all" deletes every rule)
+func (rs *RuleSet) remove(id string) bool {
+	rs.Lock()
+	defer rs.Unlock()
+	if id == "all" {
+		removed := len(rs.rules) > 0
+		rs.rules = nil
+		return removed
+	}
+	for i, rule := range rs.rules {
+		if rule.ID == id {
+			rs.rules = append(rs.rules[:i], rs.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// list ... active rules (expired rules are purged)
+func (rs *RuleSet) list() []Rule {
+	rs.Lock()
+	defer rs.Unlock()
+	now := time.Now()
+	active := rs.rules[:0]
+	list := []Rule{}
+	for _, rule := range rs.rules {
+		if rule.ExpiresAt.After(now) {
+			active = append(active, rule)
+			list = append(list, *rule)
+		}
+	}
+	for i := len(active); i < len(rs.rules); i++ {
+		rs.rules[i] = nil
+	}
+	rs.rules = active
+	return list
+}
+
+// resolve ... merge actions of rules whose conditions match the request on top of base
+func (rs *RuleSet) resolve(reqInfo *RequestInfo, base map[string]string) map[string]string {
+	for _, rule := range rs.list() {
+		if !rule.matches(reqInfo) {
+			continue
+		}
+		for key, value := range rule.Actions {
+			base[key] = value
+		}
+	}
+	return base
+}
+
+func (rule *Rule) matches(reqInfo *RequestInfo) bool {
+	for key, value := range rule.Conditions {
+		if !reqInfo.matchesValue(key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHostCondition ... conditions decided by this node, not by each request
+func isHostCondition(key string) bool {
+	return key == "ifhost" || key == "ifhostip" || key == "ifaz"
+}
+
+// applyPersist ... install or remove rules when host conditions match this node
+// ifclientip 等のリクエスト単位の条件はルールの条件として保持し、以降のリクエストごとに評価する
+func (qs *QueryString) applyPersist(reqInfo *RequestInfo) {
+	if qs.Persist == "" && qs.Unpersist == "" {
+		return
+	}
+	actions := map[string]string{}
+	conditions := map[string]string{}
+	for key, value := range qs.values {
+		switch {
+		case key == "persist" || key == "unpersist":
+		case strings.HasPrefix(key, "if"):
+			if isHostCondition(key) && !reqInfo.matchesValue(key, value) {
+				return
+			}
+			if !isHostCondition(key) {
+				conditions[key] = value
+			}
+		default:
+			actions[key] = value
+		}
+	}
+	if qs.Unpersist != "" {
+		if !store.rules.remove(qs.Unpersist) {
+			fmt.Printf("rule not found: %s\n", qs.Unpersist)
+		}
+	}
+	if qs.Persist != "" && len(actions) > 0 {
+		store.rules.add(actions, conditions, parseTTL(qs.Persist))
+	}
+}
+
+// parseTTL ... "60" (seconds), "60s", "5m", "1h", "500ms"
+func parseTTL(value string) time.Duration {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	ttl, _ := time.ParseDuration(value)
+	return ttl
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const rampInterval = time.Second
+
+// Scenario ... timeline of resource targets, default actions and health state
+type Scenario struct {
+	Name   string         `yaml:"name" json:"name"`
+	Repeat int            `yaml:"repeat" json:"repeat,omitempty"`
+	Steps  []ScenarioStep `yaml:"steps" json:"steps"`
+}
+
+// ScenarioStep ... one step of scenario
+// cpu/memory を省略した場合は前のステップの値を維持する
+// ramp=true の場合は duration をかけて前のステップの値から線形に変化させる
+type ScenarioStep struct {
+	Name     string            `yaml:"name" json:"name,omitempty"`
+	Duration string            `yaml:"duration" json:"duration"`
+	CPU      *float64          `yaml:"cpu" json:"cpu,omitempty"`
+	Memory   *float64          `yaml:"memory" json:"memory,omitempty"`
+	Ramp     bool              `yaml:"ramp" json:"ramp,omitempty"`
+	Actions  map[string]string `yaml:"actions" json:"actions,omitempty"`
+	Health   string            `yaml:"health" json:"health,omitempty"`
+	Repeat   int               `yaml:"repeat" json:"repeat,omitempty"`
+	duration time.Duration
+}
+
+// ScenarioStatus ... progress of running scenario
+// Actions は実行中のステップのアクションで、管理API の /defaults とは別に全リクエストに適用する
+type ScenarioStatus struct {
+	Name          string            `json:"name"`
+	Running       bool              `json:"running"`
+	Iteration     int               `json:"iteration"`
+	StepIndex     int               `json:"stepindex"`
+	Step          string            `json:"step,omitempty"`
+	StepRepeat    int               `json:"steprepeat"`
+	StepStartedAt time.Time         `json:"stepstartedat"`
+	StartedAt     time.Time         `json:"startedat"`
+	Actions       map[string]string `json:"actions,omitempty"`
+}
+
+// ScenarioRunner ... runs at most one scenario at a time
+// control は start/cancel を直列化する(実行中の goroutine は取らないため停止を待っても詰まらない)
+type ScenarioRunner struct {
+	*sync.RWMutex
+	control  *sync.Mutex
+	scenario *Scenario
+	status   ScenarioStatus
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newScenarioRunner() *ScenarioRunner {
+	return &ScenarioRunner{RWMutex: &sync.RWMutex{}, control: &sync.Mutex{}}
+}
+
+// parseScenario ... yaml (or json) document to scenario
+func parseScenario(data []byte) (*Scenario, error) {
+	scenario := &Scenario{}
+	if err := yaml.Unmarshal(data, scenario); err != nil {
+		return nil, err
+	}
+	if len(scenario.Steps) == 0 {
+		return nil, fmt.Errorf("scenario has no steps")
+	}
+	if scenario.Repeat < 1 {
+		scenario.Repeat = 1
+	}
+	for i := range scenario.Steps {
+		step := &scenario.Steps[i]
+		d, err := time.ParseDuration(step.Duration)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("step %d: invalid duration: %s", i, step.Duration)
+		}
+		step.duration = d
+		for _, v := range []*float64{step.CPU, step.Memory} {
+			if v != nil && (*v < 0 || 100 < *v) {
+				return nil, fmt.Errorf("step %d: target must be 0-100: %v", i, *v)
+			}
+		}
+		if err := validateActions(step.Actions); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+		switch step.Health {
+		case "", "healthy", "unhealthy":
+		default:
+			return nil, fmt.Errorf("step %d: invalid health: %s", i, step.Health)
+		}
+		if step.Repeat < 1 {
+			step.Repeat = 1
+		}
+	}
+	return scenario, nil
+}
+
+func loadScenarioFile(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseScenario(data)
+}
+
+func (sr *ScenarioRunner) getStatus() *ScenarioStatus {
+	sr.RLock()
+	defer sr.RUnlock()
+	if sr.scenario == nil {
+		return nil
+	}
+	status := sr.status
+	return &status
+}
+
+func (sr *ScenarioRunner) getScenario() *Scenario {
+	sr.RLock()
+	defer sr.RUnlock()
+	return sr.scenario
+}
+
+// getActions ... actions of running step (nil if no scenario is running)
+func (sr *ScenarioRunner) getActions() map[string]string {
+	sr.RLock()
+	defer sr.RUnlock()
+	if !sr.status.Running {
+		return nil
+	}
+	actions := map[string]string{}
+	for key, value := range sr.status.Actions {
+		actions[key] = value
+	}
+	return actions
+}
+
+func (sr *ScenarioRunner) setStep(iteration, index, repeat int, step *ScenarioStep) {
+	sr.Lock()
+	defer sr.Unlock()
+	sr.status.Iteration = iteration
+	sr.status.StepIndex = index
+	sr.status.StepRepeat = repeat
+	sr.status.Step = step.Name
+	sr.status.StepStartedAt = time.Now()
+	sr.status.Actions = step.Actions
+}
+
+// start ... stop running scenario and start new one
+func (sr *ScenarioRunner) start(scenario *Scenario) {
+	sr.control.Lock()
+	defer sr.control.Unlock()
+	sr.stopRunning()
+	sr.Lock()
+	defer sr.Unlock()
+	sr.scenario = scenario
+	sr.status = ScenarioStatus{Name: scenario.Name, Running: true, StartedAt: time.Now()}
+	sr.stop = make(chan struct{})
+	sr.done = make(chan struct{})
+	go sr.run(scenario, sr.stop, sr.done)
+}
+
+// cancel ... stop running scenario and wait for it
+func (sr *ScenarioRunner) cancel() {
+	sr.control.Lock()
+	defer sr.control.Unlock()
+	sr.stopRunning()
+}
+
+// stopRunning ... stop scenario and wait for it (control を取得して呼ぶ)
+func (sr *ScenarioRunner) stopRunning() {
+	sr.Lock()
+	stop, done := sr.stop, sr.done
+	sr.stop, sr.done = nil, nil
+	sr.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (sr *ScenarioRunner) run(scenario *Scenario, stop, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		sr.Lock()
+		sr.status.Running = false
+		sr.status.Actions = nil
+		sr.Unlock()
+		fmt.Printf("scenario %s finished\n", scenario.Name)
+	}()
+	for iteration := 1; iteration <= scenario.Repeat; iteration++ {
+		for index, step := range scenario.Steps {
+			for repeat := 1; repeat <= step.Repeat; repeat++ {
+				sr.setStep(iteration, index, repeat, &step)
+				fmt.Printf("scenario %s: iteration %d step %d(%s) repeat %d\n", scenario.Name, iteration, index, step.Name, repeat)
+				if !runStep(&step, stop) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// runStep ... apply step and wait for its duration (false if stopped)
+// ステップのアクションは setStep で ScenarioStatus に保持し、defaultActions で適用する
+func runStep(step *ScenarioStep, stop chan struct{}) bool {
+	switch step.Health {
+	case "healthy":
+		store.health.setHealthy(true)
+	case "unhealthy":
+		store.health.setHealthy(false)
+	}
+
+	fromCPU, fromMemory := store.resource.CPU.getTarget(), store.resource.Memory.getTarget()
+	toCPU, toMemory := fromCPU, fromMemory
+	if step.CPU != nil {
+		toCPU = *step.CPU
+		// applyResource と同様に全体のターゲットに切り替え、コア単位の負荷は解除する
+		store.resource.coreTargets.set(nil)
+	}
+	if step.Memory != nil {
+		toMemory = *step.Memory
+	}
+	if !step.Ramp {
+		store.resource.CPU.setTarget(toCPU)
+		store.resource.Memory.setTarget(toMemory)
+	}
+
+	startedAt := time.Now()
+	timer := time.NewTimer(step.duration)
+	defer timer.Stop()
+	ticker := time.NewTicker(rampInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timer.C:
+			store.resource.CPU.setTarget(toCPU)
+			store.resource.Memory.setTarget(toMemory)
+			return true
+		case <-ticker.C:
+			if step.Ramp {
+				progress := float64(time.Since(startedAt)) / float64(step.duration)
+				if progress > 1 {
+					progress = 1
+				}
+				store.resource.CPU.setTarget(fromCPU + (toCPU-fromCPU)*progress)
+				store.resource.Memory.setTarget(fromMemory + (toMemory-fromMemory)*progress)
+			}
+		case <-stop:
+			return false
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownOption ... behaviour on SIGTERM/SIGINT
+type ShutdownOption struct {
+	Mode    string
+	Delay   int
+	Timeout int
+}
+
+// waitShutdown ... block until signal is received and stop servers
+// graceful: Delay 秒間は通常通り応答(ヘルスチェックは失敗)した後、Timeout 秒を上限に処理中のリクエストを待って停止する
+// abrupt  : 処理中のリクエストも待たずに即座に終了する
+func waitShutdown(opt *ShutdownOption, servers []*http.Server) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	fmt.Printf("received signal: %v (mode=%s)\n", sig, opt.Mode)
+
+	if opt.Mode == "abrupt" {
+		os.Exit(1)
+	}
+
+	store.health.setDraining(true)
+	for _, srv := range servers {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	if opt.Delay > 0 {
+		fmt.Printf("keep serving for %d sec\n", opt.Delay)
+		time.Sleep(time.Duration(opt.Delay) * time.Second)
+	}
+
+	fmt.Printf("draining in-flight requests (timeout %d sec)\n", opt.Timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opt.Timeout)*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				fmt.Printf("failed to shutdown %s: %v\n", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	fmt.Println("shutdown completed")
+}
+
+// withDraining ... ask clients to close connection while draining
+func withDraining(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if store.health.isDraining() {
+			w.Header().Set("Connection", "close")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
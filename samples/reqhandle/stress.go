@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ioTick           = 100              // io の書き込み間隔(ミリ秒)
+	ioFileSize       = 256 << 20        // スクラッチファイルの最大サイズ(超えたら先頭から上書き)
+	ioBlockSize      = 1 << 20          // 1 回の write/read サイズ
+	fdReserve        = 32               // 管理API 等で解放できるように残しておく fd 数
+	maxParkedThreads = 5000             // Go ランタイムの上限(10000)に達すると異常終了するため
+	ioUnit           = float64(1 << 20) // io ターゲットの単位(MiB/s)
+)
+
+// StressOption ... settings of io/fds/threads stressors
+type StressOption struct {
+	ScratchDir string
+}
+
+// stressController ... start io/fds/threads stressors
+func stressController(opt *StressOption) {
+	if limit, err := fdLimit(); err == nil {
+		store.resource.FDs.setLimit(float64(limit))
+	}
+	go ioController(opt.ScratchDir)
+	go fdController()
+	go threadController()
+}
+
+// resolveFDs ... "N" or "N%" (of RLIMIT_NOFILE) to number of fds
+// RLIMIT_NOFILE が分かる場合は fdReserve 個を残した数に切り詰める
+func resolveFDs(value string) float64 {
+	limit := store.resource.FDs.getLimit()
+	var v float64
+	if strings.HasSuffix(value, "%") {
+		percent, _ := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		v = float64(int(limit * percent / 100))
+	} else {
+		v, _ = strconv.ParseFloat(value, 64)
+	}
+	if limit > 0 && v > limit-fdReserve {
+		v = math.Max(limit-fdReserve, 0)
+	}
+	return v
+}
+
+// resolveThreads ... number of threads to park (at most maxParkedThreads)
+func resolveThreads(v float64) float64 {
+	return math.Min(v, maxParkedThreads)
+}
+
+// ioController ... write (with fsync) and read back target MiB/s to scratch file
+// 書き込みと読み込みの合計がターゲットとなるように半分ずつ行う
+func ioController(dir string) {
+	var file *os.File
+	var offset int64
+	buf := make([]byte, ioBlockSize)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	var done float64
+	measuredAt := time.Now()
+	t := time.NewTicker(time.Duration(ioTick) * time.Millisecond)
+	defer t.Stop()
+	for {
+		<-t.C
+		if elapsed := time.Since(measuredAt); elapsed >= time.Second {
+			store.resource.IO.setCurrent(done / ioUnit / elapsed.Seconds())
+			done, measuredAt = 0, time.Now()
+		}
+		target := store.resource.IO.getTarget()
+		if target == 0 {
+			if file != nil {
+				file.Close()
+				os.Remove(file.Name())
+				file, offset = nil, 0
+			}
+			continue
+		}
+		if file == nil {
+			var err error
+			if file, err = ioutil.TempFile(dir, "reqhandle-io-"); err != nil {
+				fmt.Printf("failed to create scratch file: %v\n", err)
+				store.resource.IO.setTarget(0)
+				continue
+			}
+		}
+		remain := int64(target * ioUnit / 2 * ioTick / 1000)
+		start := offset
+		for remain > 0 {
+			n := int64(len(buf))
+			if remain < n {
+				n = remain
+			}
+			if offset+n > ioFileSize {
+				offset = 0
+				start = 0
+			}
+			if _, err := file.WriteAt(buf[:n], offset); err != nil {
+				fmt.Printf("failed to write scratch file: %v\n", err)
+				break
+			}
+			offset += n
+			remain -= n
+			done += float64(n)
+		}
+		if err := file.Sync(); err != nil {
+			fmt.Printf("failed to fsync scratch file: %v\n", err)
+		}
+		dropPageCache(file)
+		for pos := start; pos < offset; pos += int64(len(buf)) {
+			n := int64(len(buf))
+			if offset-pos < n {
+				n = offset - pos
+			}
+			if _, err := file.ReadAt(buf[:n], pos); err != nil {
+				fmt.Printf("failed to read scratch file: %v\n", err)
+				break
+			}
+			done += float64(n)
+		}
+	}
+}
+
+// fdController ... hold target number of open file descriptors
+func fdController() {
+	var files []*os.File
+	t := time.NewTicker(time.Duration(statInterval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		<-t.C
+		target := int(store.resource.FDs.getTarget())
+		for len(files) < target {
+			f, err := os.Open(os.DevNull)
+			if err != nil {
+				fmt.Printf("failed to open fd: %v\n", err)
+				break
+			}
+			files = append(files, f)
+		}
+		for len(files) > target {
+			files[len(files)-1].Close()
+			files = files[:len(files)-1]
+		}
+		store.resource.FDs.setCurrent(float64(len(files)))
+	}
+}
+
+// threadController ... park target number of OS threads
+// LockOSThread した goroutine をブロックさせることでスレッドを占有する
+func threadController() {
+	var parked []chan struct{}
+	t := time.NewTicker(time.Duration(statInterval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		<-t.C
+		target := int(store.resource.Threads.getTarget())
+		for len(parked) < target {
+			release := make(chan struct{})
+			go func() {
+				runtime.LockOSThread()
+				<-release
+				// Unlock せずに終了させてスレッド自体を破棄する
+			}()
+			parked = append(parked, release)
+		}
+		for len(parked) > target {
+			close(parked[len(parked)-1])
+			parked = parked[:len(parked)-1]
+		}
+		store.resource.Threads.setCurrent(float64(len(parked)))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinCurrentThread ... bind the calling OS thread to the core
+// 呼び出し元で runtime.LockOSThread し、UnlockOSThread せずに goroutine を終了させること
+func pinCurrentThread(core int) error {
+	set := unix.CPUSet{}
+	set.Set(core)
+	return unix.SchedSetaffinity(0, &set)
+}
+
+// dropPageCache ... evict pages of the file so that next read hits the disk
+// fsync 済みのページのみ破棄される
+func dropPageCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// fdLimit ... soft limit of RLIMIT_NOFILE
+func fdLimit() (uint64, error) {
+	rlim := unix.Rlimit{}
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, err
+	}
+	return rlim.Cur, nil
+}
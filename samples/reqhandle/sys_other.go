@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// pinCurrentThread ... thread affinity is only supported on linux
+func pinCurrentThread(core int) error {
+	return fmt.Errorf("thread affinity is not supported on %s", runtime.GOOS)
+}
+
+// dropPageCache ... page cache control is only supported on linux
+func dropPageCache(f *os.File) error {
+	return nil
+}
+
+// fdLimit ... RLIMIT_NOFILE is only read on linux
+func fdLimit() (uint64, error) {
+	return 0, fmt.Errorf("RLIMIT_NOFILE is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLSOption ... settings of tls listener
+type TLSOption struct {
+	Port       int
+	CertFiles  string
+	KeyFiles   string
+	MinVersion string
+	MaxVersion string
+	Ciphers    string
+	ClientAuth string
+	Fault      string
+}
+
+// TLSInfo ... information of negotiated tls connection
+type TLSInfo struct {
+	Version     string   `json:"version"`
+	CipherSuite string   `json:"ciphersuite"`
+	ServerName  string   `json:"sni,omitempty"`
+	ALPN        string   `json:"alpn,omitempty"`
+	Resumed     bool     `json:"resumed"`
+	ClientCerts []string `json:"clientcerts,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLSv" + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func newTLSInfo(cs *tls.ConnectionState) *TLSInfo {
+	if cs == nil {
+		return nil
+	}
+	info := &TLSInfo{
+		Version:     tlsVersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ServerName:  cs.ServerName,
+		ALPN:        cs.NegotiatedProtocol,
+		Resumed:     cs.DidResume,
+	}
+	for _, cert := range cs.PeerCertificates {
+		info.ClientCerts = append(info.ClientCerts, cert.Subject.String())
+	}
+	return info
+}
+
+func newTLSConfig(opt *TLSOption) (*tls.Config, error) {
+	conf := &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if opt.MinVersion != "" {
+		v, ok := tlsVersions[opt.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version: %s", opt.MinVersion)
+		}
+		conf.MinVersion = v
+	}
+	if opt.MaxVersion != "" {
+		v, ok := tlsVersions[opt.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version: %s", opt.MaxVersion)
+		}
+		conf.MaxVersion = v
+	}
+	if opt.Ciphers != "" {
+		ids, err := parseCipherSuites(opt.Ciphers)
+		if err != nil {
+			return nil, err
+		}
+		conf.CipherSuites = ids
+	}
+	switch opt.ClientAuth {
+	case "", "none":
+		conf.ClientAuth = tls.NoClientCert
+	case "request":
+		conf.ClientAuth = tls.RequestClientCert
+	case "require":
+		conf.ClientAuth = tls.RequireAnyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode: %s", opt.ClientAuth)
+	}
+
+	// 複数の証明書を登録した場合は SNI と SAN が一致するものが選択される
+	switch {
+	case opt.Fault != "" && opt.Fault != "none":
+		cert, err := generateCertificate(opt.Fault)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case opt.CertFiles != "":
+		certs, err := loadCertificates(opt.CertFiles, opt.KeyFiles)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = certs
+	default:
+		cert, err := generateCertificate("")
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if err := checkCipherSuites(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// checkCipherSuites ... every certificate must have a cipher suite of -tls-ciphers usable with its key
+// TLS 1.2 以下の ECDHE_ECDSA は ECDSA(Ed25519) 鍵、RSA を含むものは RSA 鍵の証明書でしか使えない
+func checkCipherSuites(conf *tls.Config) error {
+	if conf.CipherSuites == nil {
+		return nil
+	}
+	for _, cert := range conf.Certificates {
+		signer, ok := cert.PrivateKey.(crypto.Signer)
+		if !ok {
+			continue
+		}
+		keyType := "ECDSA"
+		if _, ok := signer.Public().(*rsa.PublicKey); ok {
+			keyType = "RSA"
+		}
+		usable := false
+		for _, id := range conf.CipherSuites {
+			if strings.Contains(tls.CipherSuiteName(id), "_ECDSA_") == (keyType == "ECDSA") {
+				usable = true
+				break
+			}
+		}
+		if !usable {
+			return fmt.Errorf("no cipher suite in -tls-ciphers is usable with %s key of certificate", keyType)
+		}
+	}
+	return nil
+}
+
+// http2Compatible ... whether HTTP/2 can be negotiated with conf
+// HTTP/2 は TLS 1.2 以上で、暗号スイートを限定する場合は AES_128_GCM_SHA256 の ECDHE スイートが必要
+func http2Compatible(conf *tls.Config) bool {
+	if conf.MaxVersion != 0 && conf.MaxVersion < tls.VersionTLS12 {
+		return false
+	}
+	if conf.CipherSuites == nil || conf.MinVersion >= tls.VersionTLS13 {
+		return true
+	}
+	for _, id := range conf.CipherSuites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCipherSuites(names string) ([]uint16, error) {
+	suites := map[string]*tls.CipherSuite{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs
+	}
+	ids := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		cs, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		// TLS 1.3 のスイートは常に有効で Config.CipherSuites では選べない
+		if tls13Only(cs) {
+			return nil, fmt.Errorf("cipher suite %s is for TLS 1.3 and cannot be configured (TLS 1.3 suites are always enabled)", cs.Name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// tls13Only ... whether cipher suite is usable only with TLS 1.3
+func tls13Only(cs *tls.CipherSuite) bool {
+	for _, v := range cs.SupportedVersions {
+		if v != tls.VersionTLS13 {
+			return false
+		}
+	}
+	return true
+}
+
+func loadCertificates(certFiles, keyFiles string) ([]tls.Certificate, error) {
+	certList := strings.Split(certFiles, ",")
+	keyList := strings.Split(keyFiles, ",")
+	if len(certList) != len(keyList) {
+		return nil, fmt.Errorf("number of cert files (%d) and key files (%d) differ", len(certList), len(keyList))
+	}
+	certs := []tls.Certificate{}
+	for i := range certList {
+		cert, err := tls.LoadX509KeyPair(strings.TrimSpace(certList[i]), strings.TrimSpace(keyList[i]))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// generateCertificate ... self-signed certificate for this host
+// fault=expired  : 有効期限切れの証明書を生成する
+// fault=wronghost: ホスト名が一致しない証明書を生成する
+func generateCertificate(fault string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"elb backend"}, CommonName: store.host.Name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	switch fault {
+	case "":
+		template.DNSNames = []string{store.host.Name, "localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		if ip := net.ParseIP(store.host.IP); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	case "expired":
+		template.DNSNames = []string{store.host.Name, "localhost"}
+		template.NotBefore = now.Add(-48 * time.Hour)
+		template.NotAfter = now.Add(-24 * time.Hour)
+	case "wronghost":
+		template.Subject.CommonName = "wrong.host.invalid"
+		template.DNSNames = []string{"wrong.host.invalid"}
+	default:
+		return tls.Certificate{}, fmt.Errorf("unknown tls fault mode: %s", fault)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func newTLSServer(opt *TLSOption) (*http.Server, error) {
+	conf, err := newTLSConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Addr:      ":" + strconv.Itoa(opt.Port),
+		TLSConfig: conf,
+	}
+	if !http2Compatible(conf) {
+		// TLSNextProto を空にすると net/http は HTTP/2 を設定しない
+		fmt.Println("HTTP/2 is disabled: tls versions or ciphers are not compatible with HTTP/2")
+		conf.NextProtos = []string{"http/1.1"}
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv, nil
+}
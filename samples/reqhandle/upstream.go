@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	upstreamDefaultTimeout = 10000 // ミリ秒
+	upstreamMaxHops        = 8     // 自分自身を呼ぶ設定でのループを防ぐ
+	upstreamMaxBody        = 1 << 20
+	traceIDHeader          = "X-Amzn-Trace-Id"
+	hopsHeader             = "X-Reqhandle-Hops"
+)
+
+// upstream modes
+const (
+	upstreamSequential = "sequential"
+	upstreamParallel   = "parallel"
+	upstreamFirst      = "first"
+)
+
+var upstreamClient = &http.Client{
+	Transport: newUpstreamTransport(),
+	// リダイレクトはそのまま結果として返す
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// クラウドのメタデータエンドポイント (EC2 IMDS, ECS task metadata)
+var metadataIPs = []net.IP{
+	net.ParseIP("169.254.169.254"),
+	net.ParseIP("169.254.170.2"),
+	net.ParseIP("fd00:ec2::254"),
+}
+
+// UpstreamOption ... settings of upstream action
+type UpstreamOption struct {
+	Allow string
+}
+
+// UpstreamAllowlist ... destinations which upstream= may call
+// "*" は任意のホスト、"*.example.com" はサブドメイン、CIDR/IP は名前解決後のアドレスで判定する
+// ループバック、リンクローカル、メタデータ等のアドレスは CIDR/IP で明示した場合のみ許可する
+type UpstreamAllowlist struct {
+	any   bool
+	hosts []string
+	nets  []*net.IPNet
+}
+
+// upstreamAllowlist ... nil means upstream= is disabled
+var upstreamAllowlist *UpstreamAllowlist
+
+// upstreamHostKey ... context key which tells the dialer that the host name is in the allowlist
+type upstreamHostKey struct{}
+
+// newUpstreamAllowlist ... parse comma separated hosts and CIDRs (empty: nil)
+func newUpstreamAllowlist(value string) (*UpstreamAllowlist, error) {
+	entries := splitUpstreams(value)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	al := &UpstreamAllowlist{}
+	for _, entry := range entries {
+		switch {
+		case entry == "*":
+			al.any = true
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			al.nets = append(al.nets, ipNet)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			al.nets = append(al.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			al.hosts = append(al.hosts, strings.ToLower(entry))
+		}
+	}
+	return al, nil
+}
+
+// allowHost ... whether url host may be resolved and dialed
+// 名前で許可されていない場合でも CIDR の指定があれば接続先アドレスで判定する
+func (al *UpstreamAllowlist) allowHost(host string) (matched, ok bool) {
+	if al == nil {
+		return false, false
+	}
+	if al.any {
+		return true, true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range al.hosts {
+		if host == pattern || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true, true
+		}
+	}
+	return false, len(al.nets) > 0
+}
+
+// allowIP ... whether resolved address may be dialed
+func (al *UpstreamAllowlist) allowIP(ip net.IP, hostMatched bool) error {
+	for _, ipNet := range al.nets {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	if blockedIP(ip) {
+		return fmt.Errorf("upstream address %s is not allowed", ip)
+	}
+	if !hostMatched {
+		return fmt.Errorf("upstream address %s is not in -upstream-allow", ip)
+	}
+	return nil
+}
+
+// blockedIP ... loopback, link-local, unspecified, multicast and metadata addresses
+func blockedIP(ip net.IP) bool {
+	for _, metadata := range metadataIPs {
+		if metadata.Equal(ip) {
+			return true
+		}
+	}
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// newUpstreamTransport ... transport which checks every dialed address against the allowlist
+// 名前解決の結果で判定するため DNS で内部アドレスを返すホストも拒否できる
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		hostMatched, _ := ctx.Value(upstreamHostKey{}).(bool)
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil {
+					return fmt.Errorf("unexpected upstream address %s", address)
+				}
+				return upstreamAllowlist.allowIP(ip, hostMatched)
+			},
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return transport
+}
+
+// UpstreamResult ... result of one downstream call
+type UpstreamResult struct {
+	URL      string          `json:"url"`
+	Status   int             `json:"status,omitempty"`
+	Latency  float64         `json:"latency"` // ミリ秒
+	Error    string          `json:"error,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Body     string          `json:"body,omitempty"`
+}
+
+// traceID ... trace id of request (generate new one in the same format as ELB if not given)
+// Root=1-<epoch seconds(8 hex)>-<96 bit random(24 hex)>
+func traceID(r *http.Request) string {
+	if id := r.Header.Get(traceIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("Root=1-%08x-%s", time.Now().Unix(), hex.EncodeToString(b))
+}
+
+// requestHops ... number of reqhandle instances the request has passed through
+func requestHops(r *http.Request) int {
+	hops, _ := strconv.Atoi(r.Header.Get(hopsHeader))
+	return hops
+}
+
+// callUpstreams ... call downstream urls according to mode
+func callUpstreams(reqInfo *RequestInfo, urls []string, mode string, timeout time.Duration) []UpstreamResult {
+	results := make([]UpstreamResult, len(urls))
+	if reqInfo.Hops >= upstreamMaxHops {
+		for i, url := range urls {
+			results[i] = UpstreamResult{URL: url, Error: fmt.Sprintf("too many hops (%d)", reqInfo.Hops)}
+		}
+		return results
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch mode {
+	case upstreamParallel, upstreamFirst:
+		// first は最初に応答(ステータスコードは問わない)を返したもの以外をキャンセルする
+		wg := &sync.WaitGroup{}
+		once := &sync.Once{}
+		for i := range urls {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = callUpstream(ctx, reqInfo, urls[i])
+				if mode == upstreamFirst && results[i].Error == "" {
+					once.Do(cancel)
+				}
+			}(i)
+		}
+		wg.Wait()
+	default:
+		for i := range urls {
+			results[i] = callUpstream(ctx, reqInfo, urls[i])
+		}
+	}
+	return results
+}
+
+func callUpstream(ctx context.Context, reqInfo *RequestInfo, url string) (result UpstreamResult) {
+	result.URL = url
+	start := time.Now()
+	defer func() {
+		result.Latency = float64(time.Since(start).Microseconds()) / 1000
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if upstreamAllowlist == nil {
+		result.Error = "upstream is disabled (-upstream-allow)"
+		return result
+	}
+	matched, ok := upstreamAllowlist.allowHost(req.URL.Hostname())
+	if !ok {
+		result.Error = fmt.Sprintf("upstream host %s is not in -upstream-allow", req.URL.Hostname())
+		return result
+	}
+	req = req.WithContext(context.WithValue(ctx, upstreamHostKey{}, matched))
+	req.Header.Set(traceIDHeader, reqInfo.TraceID)
+	req.Header.Set(hopsHeader, strconv.Itoa(reqInfo.Hops+1))
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, upstreamMaxBody))
+	if err != nil {
+		result.Error = err.Error()
+	}
+	// reqhandle (JSON) の応答はそのまま埋め込み、それ以外は文字列として含める
+	if json.Valid(body) {
+		result.Response = body
+	} else {
+		result.Body = strings.TrimSpace(string(body))
+	}
+	return result
+}
+
+// splitUpstreams ... comma separated urls
+func splitUpstreams(value string) []string {
+	urls := []string{}
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
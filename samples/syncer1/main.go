@@ -8,7 +8,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -16,6 +15,9 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/miyaz/go-examples/internal/hlc"
+	"github.com/miyaz/go-examples/internal/netaddr"
 )
 
 // DataStore ... Variables that use mutex
@@ -32,11 +34,12 @@ type HostInfo struct {
 }
 
 // NodeInfo ... information of node
+// Time は各ホストの時計のずれの影響を受けないように HLC とする
 type NodeInfo struct {
 	*sync.RWMutex
-	Count     int64 `json:"count"`
-	Time      int64 `json:"time"`
-	Reachable bool  `json:"reachable"`
+	Count     int64         `json:"count"`
+	Time      hlc.Timestamp `json:"time"`
+	Reachable bool          `json:"reachable"`
 }
 
 func (ni *NodeInfo) getCount() int64 {
@@ -53,14 +56,14 @@ func (ni *NodeInfo) countUp() {
 	ni.Lock()
 	defer ni.Unlock()
 	ni.Count++
-	ni.Time = time.Now().UnixNano()
+	ni.Time = clock.Now()
 }
-func (ni *NodeInfo) getTime() int64 {
+func (ni *NodeInfo) getTime() hlc.Timestamp {
 	ni.RLock()
 	defer ni.RUnlock()
 	return ni.Time
 }
-func (ni *NodeInfo) setTime(_time int64) {
+func (ni *NodeInfo) setTime(_time hlc.Timestamp) {
 	ni.Lock()
 	defer ni.Unlock()
 	ni.Time = _time
@@ -84,26 +87,36 @@ func (ni *NodeInfo) getClone() *NodeInfo {
 func (ni *NodeInfo) setNow() {
 	ni.Lock()
 	defer ni.Unlock()
-	ni.Time = time.Now().UnixNano()
+	ni.Time = clock.Now()
 }
 
 // Syncer ... Latest Data for Syncer
+// Sent は送信時の物理時刻(UnixNano)。HLC の Time は受信で相手に揃うため、時計のずれは Sent から求める
+// Skew は同期先ノードごとに観測した時計のずれ
 type Syncer struct {
 	*sync.RWMutex
-	Time  int64             `json:"time"`
-	Nodes map[int]*NodeInfo `json:"nodes"`
+	Time  hlc.Timestamp        `json:"time"`
+	Sent  int64                `json:"sent"`
+	Nodes map[int]*NodeInfo    `json:"nodes"`
+	Skew  map[int]hlc.PeerSkew `json:"skew,omitempty"`
 }
 
 func (s *Syncer) setNow() {
 	s.Lock()
 	defer s.Unlock()
-	s.Time = time.Now().UnixNano()
+	s.Time = clock.Now()
+	s.Sent = time.Now().UnixNano()
 }
-func (s *Syncer) getTime() int64 {
+func (s *Syncer) getTime() hlc.Timestamp {
 	s.RLock()
 	defer s.RUnlock()
 	return s.Time
 }
+func (s *Syncer) setSkew(port int, skew hlc.PeerSkew) {
+	s.Lock()
+	defer s.Unlock()
+	s.Skew[port] = skew
+}
 
 // RequestInfo ... information of request
 type RequestInfo struct {
@@ -122,29 +135,24 @@ type ResponseInfo struct {
 	Request RequestInfo `json:"request"`
 }
 
+// clock ... hybrid logical clock of this node (送信とローカルの更新では Now、受信では Update を呼ぶ)
+var clock = hlc.NewClock()
+
 var store = &DataStore{
 	&sync.RWMutex{},
 	&HostInfo{},
-	&NodeInfo{&sync.RWMutex{}, 0, time.Now().UnixNano(), true},
+	&NodeInfo{&sync.RWMutex{}, 0, clock.Now(), true},
 }
 var listenPort int
-var syncer = Syncer{&sync.RWMutex{}, time.Now().UnixNano(), map[int]*NodeInfo{}}
+var syncer = Syncer{&sync.RWMutex{}, clock.Now(), time.Now().UnixNano(), map[int]*NodeInfo{}, map[int]hlc.PeerSkew{}}
 
 func getIPAddress() string {
-	var currentIP string
-	addrs, err := net.InterfaceAddrs()
+	addrs, err := netaddr.Interfaces()
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				fmt.Println("Current IP address : ", ipnet.IP.String())
-				currentIP = ipnet.IP.String()
-			}
-		}
-	}
+	currentIP := netaddr.Primary(addrs, netaddr.IPv4)
+	fmt.Println("Current IP address : ", currentIP)
 	return currentIP
 }
 
@@ -217,6 +225,7 @@ func syncerHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprint(w, "Bad Request\n")
 			fmt.Printf("failed to json.MarshalIndent: %v", err)
 		} else {
+			clock.Update(wkSyncer.Time)
 			mergeSyncer(&wkSyncer)
 			fmt.Fprintln(w, string(getSyncerJSON()))
 		}
@@ -238,7 +247,7 @@ func mergeSyncer(inSyncer *Syncer) {
 			inNode.RWMutex = &sync.RWMutex{}
 		}
 		if node, ok := syncer.Nodes[inPort]; ok {
-			if node.getTime() < inNode.getTime() {
+			if node.getTime().Less(inNode.getTime()) {
 				syncer.Nodes[inPort].setCount(inNode.getCount())
 				syncer.Nodes[inPort].setTime(inNode.getTime())
 				syncer.Nodes[inPort].setReachable(inNode.isReachable())
@@ -272,20 +281,9 @@ func updateSyncer() {
 }
 
 func (reqInfo *RequestInfo) setIPAddresse(r *http.Request) {
-	//reqInfo.TargetIP = extractIPAddress(r.Host)
+	//reqInfo.TargetIP = netaddr.Host(r.Host)
 	reqInfo.TargetIP = r.Host
-	reqInfo.ClientIP = extractIPAddress(r.RemoteAddr)
-}
-
-func extractIPAddress(ipport string) string {
-	var ipaddr string
-	if strings.HasPrefix(ipport, "[") {
-		ipaddr = strings.Join(strings.Split(ipport, ":")[:len(strings.Split(ipport, ":"))-1], ":")
-		ipaddr = strings.Trim(ipaddr, "[]")
-	} else {
-		ipaddr = strings.Split(ipport, ":")[0]
-	}
-	return ipaddr
+	reqInfo.ClientIP = netaddr.Host(r.RemoteAddr)
 }
 
 func loopSyncer() {
@@ -300,7 +298,7 @@ func loopSyncer() {
 			now := time.Now().UnixNano()
 			destPort := listenPort
 			for inPort := range syncer.Nodes {
-				curTime := syncer.Nodes[inPort].getTime()
+				curTime := syncer.Nodes[inPort].getTime().Wall
 				if minTime > curTime && syncer.Nodes[inPort].isReachable() {
 					minTime = curTime
 					destPort = inPort
@@ -311,7 +309,7 @@ func loopSyncer() {
 				continue
 			}
 			delta := (float64)(now-minTime) / 1000000000
-			syncer.Nodes[destPort].setReachable(execSyncer("http://localhost:" + strconv.Itoa(destPort) + "/syncer/"))
+			syncer.Nodes[destPort].setReachable(execSyncer(destPort))
 			//clear()
 			fmt.Println(string(getSyncerJSON()))
 			fmt.Printf("port %d : %d - %d = %d (%f sec)\n", destPort, now, minTime, now-minTime, delta)
@@ -319,7 +317,8 @@ func loopSyncer() {
 	}
 }
 
-func execSyncer(url string) bool {
+func execSyncer(port int) bool {
+	url := "http://localhost:" + strconv.Itoa(port) + "/syncer/"
 	c := &http.Client{
 		Timeout: 500 * time.Millisecond,
 	}
@@ -331,6 +330,7 @@ func execSyncer(url string) bool {
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Close = true
+	sentAt := time.Now().UnixNano()
 	resp, err := c.Do(req)
 	if err != nil {
 		fmt.Printf("failed to c.Do: %v", err)
@@ -342,9 +342,15 @@ func execSyncer(url string) bool {
 	if err != nil {
 		fmt.Printf("failed to ioutil.ReadAll: %v", err)
 	}
+	receivedAt := time.Now().UnixNano()
 	wkSyncer := Syncer{} // RWMutex や map にアクセスしなければ初期化は不要
 	if err := json.Unmarshal(byteArray, &wkSyncer); err != nil {
 		fmt.Printf("failed to json.Unmarshal: %v", err)
+		return true
+	}
+	clock.Update(wkSyncer.Time)
+	if wkSyncer.Sent != 0 {
+		syncer.setSkew(port, hlc.NewPeerSkew(wkSyncer.Sent, sentAt, receivedAt))
 	}
 	mergeSyncer(&wkSyncer)
 	return true
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/hlc"
+)
+
+// message types of envelope
+// 1 ラウンドは digest (相手との差分を受け取る) と delta (相手に差分を送る) の 2 往復
+const (
+	msgDigest = "digest"
+	msgDelta  = "delta"
+)
+
+// SyncMessage ... payload of envelope
+// Digest はノードごとのバージョン (UpdatedAt の HLC)、Entries はバージョンが新しいノードのみ含む
+type SyncMessage struct {
+	Digest    map[int]hlc.Timestamp `json:"digest,omitempty"`
+	Entries   map[int]NodeState     `json:"entries,omitempty"`
+	Truncated bool                  `json:"truncated,omitempty"`
+}
+
+// SyncMetrics ... bandwidth and convergence of rounds started by this node
+type SyncMetrics struct {
+	*sync.RWMutex
+	Rounds          int64   `json:"rounds"`
+	BytesSent       int64   `json:"bytes_sent"`
+	BytesReceived   int64   `json:"bytes_received"`
+	LastRoundBytes  int64   `json:"last_round_bytes"`
+	MaxRoundBytes   int64   `json:"max_round_bytes"`
+	EntriesSent     int64   `json:"entries_sent"`
+	EntriesReceived int64   `json:"entries_received"`
+	TruncatedRounds int64   `json:"truncated_rounds"`
+	LastConvergence float64 `json:"last_convergence_sec"`
+	MaxConvergence  float64 `json:"max_convergence_sec"`
+}
+
+var metrics = &SyncMetrics{RWMutex: &sync.RWMutex{}}
+
+// addRound ... record one round
+// convergence は受信したエントリが更新されてから自ノードに届くまでの時間(ラウンド内の最大値)
+func (sm *SyncMetrics) addRound(sent, received, entriesSent, entriesReceived int, truncated bool, convergence float64) {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.Rounds++
+	sm.BytesSent += int64(sent)
+	sm.BytesReceived += int64(received)
+	sm.LastRoundBytes = int64(sent + received)
+	if sm.LastRoundBytes > sm.MaxRoundBytes {
+		sm.MaxRoundBytes = sm.LastRoundBytes
+	}
+	sm.EntriesSent += int64(entriesSent)
+	sm.EntriesReceived += int64(entriesReceived)
+	if truncated {
+		sm.TruncatedRounds++
+	}
+	sm.LastConvergence = convergence
+	if convergence > sm.MaxConvergence {
+		sm.MaxConvergence = convergence
+	}
+}
+func (sm *SyncMetrics) getClone() SyncMetrics {
+	sm.RLock()
+	defer sm.RUnlock()
+	clone := *sm
+	clone.RWMutex = nil
+	return clone
+}
+
+// makeDigest ... version of every node
+func makeDigest() map[int]hlc.Timestamp {
+	digest := map[int]hlc.Timestamp{}
+	for port, node := range syncer.snapshot().Nodes {
+		digest[port] = node.UpdatedAt
+	}
+	return digest
+}
+
+// makeDelta ... nodes newer than digest of peer within maxBytes
+// 上限を超える場合は相手のバージョンとの差が大きいものから詰め、残りは次のラウンドに回す
+func makeDelta(digest map[int]hlc.Timestamp, maxBytes int) (map[int]NodeState, bool) {
+	type candidate struct {
+		port int
+		lag  int64
+		node NodeState
+	}
+	candidates := []candidate{}
+	for port, node := range syncer.snapshot().Nodes {
+		if peerVersion, ok := digest[port]; !ok || peerVersion.Less(node.UpdatedAt) {
+			candidates = append(candidates, candidate{port, node.UpdatedAt.Wall - digest[port].Wall, node})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lag > candidates[j].lag
+	})
+
+	entries := map[int]NodeState{}
+	size := 0
+	for _, c := range candidates {
+		b, err := json.Marshal(c.node)
+		if err != nil {
+			continue
+		}
+		// "port":{...}, の分を加算
+		entrySize := len(b) + len(fmt.Sprint(c.port)) + 4
+		if maxBytes > 0 && size+entrySize > maxBytes {
+			return entries, true
+		}
+		size += entrySize
+		entries[c.port] = c.node
+	}
+	return entries, false
+}
+
+// convergence ... max seconds from update to arrival of entries
+func convergence(entries map[int]NodeState) float64 {
+	now := time.Now().UnixNano()
+	max := float64(0)
+	for _, node := range entries {
+		if age := float64(now-node.UpdatedAt.Wall) / 1000000000; age > max {
+			max = age
+		}
+	}
+	return max
+}
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -16,6 +13,9 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/miyaz/go-examples/internal/hlc"
+	"github.com/miyaz/go-examples/internal/netaddr"
 )
 
 // DataStore ... Variables that use mutex
@@ -34,10 +34,10 @@ type HostInfo struct {
 // NodeInfo ... information of node
 type NodeInfo struct {
 	*sync.RWMutex
-	Count     int64 `json:"count"`
-	CreatedAt int64 `json:"created_at"`
-	UpdatedAt int64 `json:"updated_at"`
-	Reachable bool  `json:"reachable"`
+	Count     int64         `json:"count"`
+	CreatedAt int64         `json:"created_at"`
+	UpdatedAt hlc.Timestamp `json:"updated_at"`
+	Reachable bool          `json:"reachable"`
 }
 
 func (ni *NodeInfo) getCount() int64 {
@@ -45,75 +45,31 @@ func (ni *NodeInfo) getCount() int64 {
 	defer ni.RUnlock()
 	return ni.Count
 }
-func (ni *NodeInfo) setCount(cnt int64) {
-	ni.Lock()
-	defer ni.Unlock()
-	ni.Count = cnt
-}
 func (ni *NodeInfo) countUp() {
 	ni.Lock()
 	defer ni.Unlock()
 	ni.Count++
-	ni.UpdatedAt = time.Now().UnixNano()
+	ni.UpdatedAt = clock.Now()
 }
 func (ni *NodeInfo) getCreatedAt() int64 {
 	ni.RLock()
 	defer ni.RUnlock()
 	return ni.CreatedAt
 }
-func (ni *NodeInfo) setCreatedAt(_time int64) {
-	ni.Lock()
-	defer ni.Unlock()
-	ni.CreatedAt = _time
-}
-func (ni *NodeInfo) getUpdatedAt() int64 {
+func (ni *NodeInfo) getUpdatedAt() hlc.Timestamp {
 	ni.RLock()
 	defer ni.RUnlock()
 	return ni.UpdatedAt
 }
-func (ni *NodeInfo) setUpdatedAt(_time int64) {
-	ni.Lock()
-	defer ni.Unlock()
-	ni.UpdatedAt = _time
-}
-func (ni *NodeInfo) isReachable() bool {
-	ni.RLock()
-	defer ni.RUnlock()
-	return ni.Reachable
-}
-func (ni *NodeInfo) setReachable(r bool) {
-	ni.Lock()
-	defer ni.Unlock()
-	ni.Reachable = r
-}
-func (ni *NodeInfo) getClone() *NodeInfo {
+func (ni *NodeInfo) getState() NodeState {
 	ni.RLock()
 	defer ni.RUnlock()
-	node := *ni
-	return &node
+	return NodeState{ni.Count, ni.CreatedAt, ni.UpdatedAt, ni.Reachable}
 }
 func (ni *NodeInfo) setNow() {
 	ni.Lock()
 	defer ni.Unlock()
-	ni.UpdatedAt = time.Now().UnixNano()
-}
-
-// Syncer ... Latest Data for Syncer
-type Syncer struct {
-	*sync.RWMutex
-	SyncedAt int64             `json:"synced_at"`
-	Nodes    map[int]*NodeInfo `json:"nodes"`
-}
-
-func (s *Syncer) setNow() {
-	s.Lock()
-	defer s.Unlock()
-	s.SyncedAt = time.Now().UnixNano()
-}
-func (s *Syncer) getSyncedAt() int64 {
-	s.RLock()
-	defer s.RUnlock()
-	return s.SyncedAt
+	ni.UpdatedAt = clock.Now()
 }
 
 // RequestInfo ... information of request
@@ -123,56 +79,72 @@ type RequestInfo struct {
 	Header   map[string]string `json:"header"`
 	ClientIP string            `json:"clientip"`
 	TargetIP string            `json:"targetip"`
-	Node     NodeInfo          `json:"node"`
+	Node     NodeState         `json:"node"`
 }
 
 // ResponseInfo ... information of response
 type ResponseInfo struct {
 	Host    HostInfo    `json:"host"`
-	Node    NodeInfo    `json:"node"`
+	Node    NodeState   `json:"node"`
 	Request RequestInfo `json:"request"`
 }
 
+// clock ... hybrid logical clock of this node (送信とローカルの更新では Now、受信では Update を呼ぶ)
+var clock = hlc.NewClock()
+
 var store = &DataStore{
 	&sync.RWMutex{},
 	&HostInfo{},
-	&NodeInfo{&sync.RWMutex{}, 0, time.Now().UnixNano(), time.Now().UnixNano(), true},
+	&NodeInfo{&sync.RWMutex{}, 0, time.Now().UnixNano(), clock.Now(), true},
 }
 var listenPort int
-var syncer = Syncer{&sync.RWMutex{}, time.Now().UnixNano(), map[int]*NodeInfo{}}
+var syncOption = &SyncOption{}
+var syncer = newSyncStore()
 
 func getIPAddress() string {
-	var currentIP string
-	addrs, err := net.InterfaceAddrs()
+	addrs, err := netaddr.Interfaces()
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				fmt.Println("Current IP address : ", ipnet.IP.String())
-				currentIP = ipnet.IP.String()
-			}
-		}
-	}
+	currentIP := netaddr.Primary(addrs, netaddr.IPv4)
+	fmt.Println("Current IP address : ", currentIP)
 	return currentIP
 }
 
 func main() {
 	flag.IntVar(&listenPort, "port", 9000, "listen port")
+	flag.IntVar(&syncOption.PortOffset, "sync-port-offset", 1000, "syncer listens on port + offset")
+	flag.StringVar(&syncOption.Bind, "sync-bind", "127.0.0.1", "syncer listen address")
+	flag.StringVar(&syncOption.Secret, "sync-secret", os.Getenv("SYNCER_SECRET"), "shared secret of syncer (default $SYNCER_SECRET)")
+	flag.IntVar(&syncOption.MaxBytes, "sync-max-bytes", 16384, "max bytes of entries sent in one round (0: unlimited)")
+	flag.DurationVar(&syncOption.ReplayWindow, "sync-replay-window", 30*time.Second, "reject messages whose hlc is older than this node's by more than this")
 	flag.Parse()
+	if syncOption.Secret == "" {
+		log.Fatalln("sync-secret (or SYNCER_SECRET) is required")
+	}
 	fmt.Println("Listen Port : ", listenPort)
+	fmt.Println("Syncer Listen Port : ", listenPort+syncOption.PortOffset)
 
-	syncer.Nodes[listenPort] = store.node
+	syncer.setLocal(listenPort, store.node.getState())
 	store.host.Name, _ = os.Hostname()
 	store.host.IP = getIPAddress()
 
 	initSyncer()
 	go loopSyncer()
 
+	// syncer は公開ポートとは別の内部ポートで待ち受ける
+	syncMux := http.NewServeMux()
+	syncMux.HandleFunc("/syncer/", syncerHandler)
+	syncSrv := &http.Server{
+		Addr:        net.JoinHostPort(syncOption.Bind, strconv.Itoa(listenPort+syncOption.PortOffset)),
+		Handler:     syncMux,
+		IdleTimeout: 65 * time.Second,
+	}
+	go func() {
+		log.Fatalln(syncSrv.ListenAndServe())
+	}()
+
 	http.HandleFunc("/", topHandler)
-	http.HandleFunc("/syncer/", syncerHandler)
 	srv := &http.Server{
 		Addr:        ":" + strconv.Itoa(listenPort),
 		IdleTimeout: 65 * time.Second,
@@ -187,20 +159,17 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 		Path:   r.URL.EscapedPath(),
 		Query:  r.URL.Query().Encode(),
 		Header: combineValues(r.Header),
-		Node: NodeInfo{
-			CreatedAt: store.node.getCreatedAt(),
-			UpdatedAt: store.node.getUpdatedAt(),
-			Count:     store.node.getCount(),
-		},
+		Node:   store.node.getState(),
 	}
 	reqInfo.setIPAddresse(r)
 	s, _ := json.MarshalIndent(reqInfo, "", "  ")
 	fmt.Fprintf(w, "\n%s\n", string(s))
 
-	syncer.RLock()
-	defer syncer.RUnlock()
-	syncerJSON, _ := json.MarshalIndent(syncer, "", "  ")
+	syncerJSON, _ := json.MarshalIndent(syncer.snapshot(), "", "  ")
 	fmt.Fprintf(w, "\n%s\n", string(syncerJSON))
+
+	metricsJSON, _ := json.MarshalIndent(metrics.getClone(), "", "  ")
+	fmt.Fprintf(w, "\n%s\n", string(metricsJSON))
 }
 
 func clear() {
@@ -218,24 +187,35 @@ func combineValues(input map[string][]string) map[string]string {
 }
 
 func syncerHandler(w http.ResponseWriter, r *http.Request) {
-	store.node.countUp()
 	switch r.Method {
 	case http.MethodGet:
 		w.WriteHeader(http.StatusBadRequest)
 	case http.MethodPost:
-		body := r.Body
-		defer body.Close()
-		buf := new(bytes.Buffer)
-		io.Copy(buf, body)
-		//wkSyncer := Syncer{&sync.RWMutex{}, time.Now().UnixNano(), map[int]NodeInfo{}}
-		wkSyncer := Syncer{} // RWMutex や map にアクセスしなければ初期化は不要
-		if err := json.Unmarshal(buf.Bytes(), &wkSyncer); err != nil {
+		env := receive(w, r)
+		if env == nil {
+			return
+		}
+		// 検証に失敗したリクエストはカウントしない
+		store.node.countUp()
+		msg := &SyncMessage{}
+		if err := json.Unmarshal(env.Payload, msg); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprint(w, "Bad Request\n")
-			fmt.Printf("failed to json.MarshalIndent: %v", err)
-		} else {
-			mergeSyncer(&wkSyncer)
-			fmt.Fprintln(w, string(getSyncerJSON()))
+			fmt.Printf("failed to json.Unmarshal: %v", err)
+			return
+		}
+		switch env.Type {
+		case msgDigest:
+			// 相手の digest より新しいエントリと自分の digest を返す
+			updateSyncer()
+			entries, truncated := makeDelta(msg.Digest, syncOption.MaxBytes)
+			reply(w, msgDelta, &SyncMessage{Digest: makeDigest(), Entries: entries, Truncated: truncated})
+		case msgDelta:
+			syncer.merge(msg.Entries)
+			reply(w, msgDelta, &SyncMessage{})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "unknown message type: %s\n", env.Type)
 		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -243,38 +223,9 @@ func syncerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func mergeSyncer(inSyncer *Syncer) {
-	if inSyncer == nil || inSyncer.Nodes == nil {
-		return
-	}
-	for inPort, inNode := range inSyncer.Nodes {
-		if inPort == listenPort {
-			continue
-		}
-		if inNode.RWMutex == nil {
-			inNode.RWMutex = &sync.RWMutex{}
-		}
-		if node, ok := syncer.Nodes[inPort]; ok {
-			if node.getUpdatedAt() < inNode.getUpdatedAt() {
-				syncer.Nodes[inPort].setCount(inNode.getCount())
-				syncer.Nodes[inPort].setCreatedAt(inNode.getCreatedAt())
-				syncer.Nodes[inPort].setUpdatedAt(inNode.getUpdatedAt())
-				syncer.Nodes[inPort].setReachable(inNode.isReachable())
-			}
-		} else {
-			syncer.Lock()
-			inNode.setReachable(true)
-			syncer.Nodes[inPort] = inNode
-			syncer.Unlock()
-		}
-	}
-}
-
 func getSyncerJSON() []byte {
 	updateSyncer()
-	syncer.RLock()
-	defer syncer.RUnlock()
-	syncerJSON, err := json.MarshalIndent(syncer, "", "  ")
+	syncerJSON, err := json.MarshalIndent(syncer.snapshot(), "", "  ")
 	if err != nil {
 		fmt.Printf("failed to json.MarshalIndent: %v", err)
 		return []byte{}
@@ -282,28 +233,14 @@ func getSyncerJSON() []byte {
 	return syncerJSON
 }
 func updateSyncer() {
-	syncer.setNow()
 	store.node.setNow()
-	syncer.Lock()
-	defer syncer.Unlock()
-	syncer.Nodes[listenPort] = store.node.getClone()
+	syncer.setLocal(listenPort, store.node.getState())
 }
 
 func (reqInfo *RequestInfo) setIPAddresse(r *http.Request) {
-	//reqInfo.TargetIP = extractIPAddress(r.Host)
+	//reqInfo.TargetIP = netaddr.Host(r.Host)
 	reqInfo.TargetIP = r.Host
-	reqInfo.ClientIP = extractIPAddress(r.RemoteAddr)
-}
-
-func extractIPAddress(ipport string) string {
-	var ipaddr string
-	if strings.HasPrefix(ipport, "[") {
-		ipaddr = strings.Join(strings.Split(ipport, ":")[:len(strings.Split(ipport, ":"))-1], ":")
-		ipaddr = strings.Trim(ipaddr, "[]")
-	} else {
-		ipaddr = strings.Split(ipport, ":")[0]
-	}
-	return ipaddr
+	reqInfo.ClientIP = netaddr.Host(r.RemoteAddr)
 }
 
 func loopSyncer() {
@@ -314,70 +251,68 @@ func loopSyncer() {
 		time.Sleep(time.Duration(sleep) * time.Millisecond)
 		//select {
 		//case <-ticker.C:
-		syncer.RLock()
 		minUpdatedAt := time.Now().UnixNano()
 		now := time.Now().UnixNano()
 		destPort := listenPort
-		for inPort := range syncer.Nodes {
-			curUpdatedAt := syncer.Nodes[inPort].getUpdatedAt()
-			if minUpdatedAt > curUpdatedAt && syncer.Nodes[inPort].isReachable() {
-				minUpdatedAt = curUpdatedAt
+		for inPort, node := range syncer.snapshot().Nodes {
+			if inPort == listenPort {
+				continue
+			}
+			if minUpdatedAt > node.UpdatedAt.Wall && node.Reachable {
+				minUpdatedAt = node.UpdatedAt.Wall
 				destPort = inPort
 			}
 		}
-		syncer.RUnlock()
 		if destPort == listenPort {
 			continue
 		}
 		delta := (float64)(now-minUpdatedAt) / 1000000000
-		syncer.Nodes[destPort].setReachable(execSyncer("http://localhost:"+strconv.Itoa(destPort)+"/syncer/", true))
+		syncer.setReachable(destPort, execSyncer(destPort, true))
 		//clear()
 		fmt.Println(string(getSyncerJSON()))
 		fmt.Printf("port %d : %d - %d = %d (%f sec)\n", destPort, now, minUpdatedAt, now-minUpdatedAt, delta)
+		m := metrics.getClone()
+		fmt.Printf("round %d : %d bytes (max %d) convergence %f sec (max %f sec)\n", m.Rounds, m.LastRoundBytes, m.MaxRoundBytes, m.LastConvergence, m.MaxConvergence)
 		//}
 	}
 }
 func initSyncer() {
 	nodes := getNodeList()
 	reachableNodes := getReachableNodeList(nodes)
-	syncer.Lock()
-	defer syncer.Unlock()
+	ports := []int{}
 	for i := 0; i < len(reachableNodes); i++ {
 		portNum, _ := strconv.Atoi(reachableNodes[i])
-		syncer.Nodes[portNum] = &NodeInfo{&sync.RWMutex{}, 0, time.Now().UnixNano(), time.Now().UnixNano(), true}
+		if portNum != listenPort {
+			ports = append(ports, portNum)
+		}
 	}
+	syncer.addPeers(ports)
 }
 
-func execSyncer(url string, merge bool) bool {
-	c := &http.Client{
-		Timeout: 500 * time.Millisecond,
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(getSyncerJSON()))
-	if err != nil {
-		fmt.Printf("failed to http.NewRequest: %v", err)
-		return false
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Close = true
-	resp, err := c.Do(req)
+// execSyncer ... one round of anti-entropy with peer (merge=false only checks reachability)
+func execSyncer(port int, merge bool) bool {
+	url := syncURL(port)
+	updateSyncer()
+	resp, sent, received, err := exchange(url, msgDigest, &SyncMessage{Digest: makeDigest()})
 	if err != nil {
-		//fmt.Printf("failed to c.Do: %v", err)
+		//fmt.Printf("failed to exchange: %v", err)
 		return false
 	}
-	defer resp.Body.Close()
-
-	byteArray, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("failed to ioutil.ReadAll: %v", err)
-	}
-	wkSyncer := Syncer{} // RWMutex や map にアクセスしなければ初期化は不要
-	if err := json.Unmarshal(byteArray, &wkSyncer); err != nil {
-		fmt.Printf("failed to json.Unmarshal: %v", err)
+	if !merge {
+		return true
 	}
-	if merge {
-		mergeSyncer(&wkSyncer)
+	lag := convergence(resp.Entries)
+	syncer.merge(resp.Entries)
+
+	entries, truncated := makeDelta(resp.Digest, syncOption.MaxBytes)
+	if len(entries) > 0 {
+		_, s, r, err := exchange(url, msgDelta, &SyncMessage{Entries: entries, Truncated: truncated})
+		sent, received = sent+s, received+r
+		if err != nil {
+			fmt.Printf("failed to send delta: %v\n", err)
+		}
 	}
+	metrics.addRound(sent, received, len(entries), len(resp.Entries), truncated || resp.Truncated, lag)
 	return true
 }
 
@@ -402,7 +337,8 @@ func getReachableNodeList(nodes []string) (reachableNodes []string) {
 			limiter <- struct{}{}
 			defer wg.Done()
 			//<-limiter
-			reachable := execSyncer("http://localhost:"+port+"/syncer/", false)
+			portNum, _ := strconv.Atoi(port)
+			reachable := execSyncer(portNum, false)
 			<-limiter
 			mu.Lock()
 			defer mu.Unlock()
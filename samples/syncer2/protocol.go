@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/hlc"
+)
+
+// protocolVersion ... version of syncer wire protocol (peers with other versions are rejected)
+// 2: digest/delta による差分同期
+// 3: HLC によるバージョン
+// 4: HLC と nonce によるリプレイ対策
+const protocolVersion = 4
+
+const (
+	signatureHeader = "X-Syncer-Signature"
+	maxMessageSize  = 10 << 20
+)
+
+// SyncOption ... settings of internal syncer listener
+// ReplayWindow より古い HLC のメッセージは拒否し、それより新しいものは nonce で再送を検出する
+type SyncOption struct {
+	PortOffset   int
+	Bind         string
+	Secret       string
+	MaxBytes     int
+	ReplayWindow time.Duration
+}
+
+// Envelope ... message exchanged between peers
+// 本文全体の HMAC-SHA256 を X-Syncer-Signature ヘッダに付与する
+// 同じメッセージの再送を拒否するため HLC とランダムな nonce を含める
+// Timestamp は送信時の物理時刻(UnixNano)で、時計のずれの観測にのみ使う
+type Envelope struct {
+	Version   int             `json:"version"`
+	From      int             `json:"from"`
+	Type      string          `json:"type"`
+	Clock     hlc.Timestamp   `json:"clock"`
+	Timestamp int64           `json:"timestamp"`
+	Nonce     string          `json:"nonce"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// NonceCache ... nonces received within replay window (nonce -> HLC wall of message)
+type NonceCache struct {
+	*sync.Mutex
+	seen map[string]int64
+}
+
+var nonces = &NonceCache{&sync.Mutex{}, map[string]int64{}}
+
+// check ... record nonce of message sent at wall and report whether it was fresh
+// horizon より古いメッセージはそもそも受け付けないので、その nonce は忘れてよい
+func (nc *NonceCache) check(nonce string, wall, horizon int64) bool {
+	nc.Lock()
+	defer nc.Unlock()
+	for n, w := range nc.seen {
+		if w < horizon {
+			delete(nc.seen, n)
+		}
+	}
+	if _, ok := nc.seen[nonce]; ok {
+		return false
+	}
+	nc.seen[nonce] = wall
+	return true
+}
+
+// newNonce ... 128 bit random hex
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// syncClient ... keep-alive connections are reused for every exchange
+var syncClient = &http.Client{
+	Timeout: 500 * time.Millisecond,
+	Transport: &http.Transport{
+		MaxIdleConns:        200,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     60 * time.Second,
+	},
+}
+
+// syncURL ... syncer endpoint of the node listening on port
+func syncURL(port int) string {
+	return fmt.Sprintf("http://localhost:%d/syncer/", port+syncOption.PortOffset)
+}
+
+// sign ... HMAC-SHA256 of body with shared secret
+func sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(syncOption.Secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// encodeEnvelope ... signed envelope of payload
+func encodeEnvelope(msgType string, payload []byte) ([]byte, string, error) {
+	body, err := json.Marshal(Envelope{
+		Version: protocolVersion, From: listenPort, Type: msgType, Clock: clock.Now(),
+		Timestamp: time.Now().UnixNano(), Nonce: newNonce(), Payload: payload,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return body, hex.EncodeToString(sign(body)), nil
+}
+
+// decodeEnvelope ... verify signature, version and freshness of envelope
+// 物理時刻は比較せず、自ノードの HLC から ReplayWindow 以上遅れたメッセージを errStale とする
+// 相手の HLC は受信のたびに追いつくので、時計が遅れたノードも応答を受け取れば受け付けられるようになる
+// errStale の場合も時計のずれを記録できるよう検証済みの env を返す
+func decodeEnvelope(body []byte, signature string) (*Envelope, error) {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, sign(body)) {
+		return nil, errInvalidSignature
+	}
+	env := &Envelope{}
+	if err := json.Unmarshal(body, env); err != nil {
+		return nil, err
+	}
+	if env.Version != protocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version: %d", env.Version)
+	}
+	horizon := clock.Now().Wall - int64(syncOption.ReplayWindow)
+	if env.Clock.Wall < horizon {
+		return env, errStale
+	}
+	if env.Nonce == "" || !nonces.check(env.Nonce, env.Clock.Wall, horizon) {
+		return nil, errReplayed
+	}
+	return env, nil
+}
+
+var errInvalidSignature = fmt.Errorf("invalid signature")
+var errReplayed = fmt.Errorf("replayed message")
+var errStale = fmt.Errorf("clock of message is too old")
+
+// exchange ... post message to peer and return message of its response with bytes sent/received
+func exchange(url, msgType string, msg *SyncMessage) (*SyncMessage, int, int, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	body, signature, err := encodeEnvelope(msgType, payload)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, signature)
+	sentAt := time.Now().UnixNano()
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return nil, len(body), 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, len(body), len(respBody), err
+	}
+	receivedAt := time.Now().UnixNano()
+	if resp.StatusCode == http.StatusConflict {
+		// 自ノードの HLC が古すぎて拒否された。相手の HLC に追いついて次の同期で再送する
+		env, err := decodeEnvelope(respBody, resp.Header.Get(signatureHeader))
+		if err != nil {
+			return nil, len(body), len(respBody), err
+		}
+		clock.Update(env.Clock)
+		syncer.setSkew(env.From, hlc.NewPeerSkew(env.Timestamp, sentAt, receivedAt))
+		return nil, len(body), len(respBody), fmt.Errorf("clock of this node was behind peer %d, adopted its clock", env.From)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, len(body), len(respBody), fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	env, err := decodeEnvelope(respBody, resp.Header.Get(signatureHeader))
+	if err != nil {
+		return nil, len(body), len(respBody), err
+	}
+	clock.Update(env.Clock)
+	// HLC の Wall は受信で揃ってしまうため、ずれは相手の物理時刻(Timestamp)から求める
+	syncer.setSkew(env.From, hlc.NewPeerSkew(env.Timestamp, sentAt, receivedAt))
+	respMsg := &SyncMessage{}
+	if err := json.Unmarshal(env.Payload, respMsg); err != nil {
+		return nil, len(body), len(respBody), err
+	}
+	return respMsg, len(body), len(respBody), nil
+}
+
+// receive ... verified payload of request (writes error response and returns nil on failure)
+func receive(w http.ResponseWriter, r *http.Request) *Envelope {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	receivedAt := time.Now().UnixNano()
+	env, err := decodeEnvelope(body, r.Header.Get(signatureHeader))
+	if err == errStale {
+		// 認証エラーではなく時計のずれとして記録し、相手が追いつけるよう自ノードの HLC を返す
+		skew := hlc.NewPeerSkew(env.Timestamp, receivedAt, receivedAt)
+		fmt.Printf("rejected syncer message from %d: %v (hlc %v, offset %.0fms)\n", env.From, err, env.Clock, skew.Offset)
+		syncer.addStale(env.From, skew)
+		replyStatus(w, http.StatusConflict, env.Type, &SyncMessage{})
+		return nil
+	}
+	if err == errInvalidSignature || err == errReplayed {
+		fmt.Printf("rejected syncer message from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("rejected syncer message from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	clock.Update(env.Clock)
+	return env
+}
+
+// reply ... write signed envelope of message
+func reply(w http.ResponseWriter, msgType string, msg *SyncMessage) {
+	replyStatus(w, http.StatusOK, msgType, msg)
+}
+
+// replyStatus ... write signed envelope of message with status
+func replyStatus(w http.ResponseWriter, status int, msgType string, msg *SyncMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, signature, err := encodeEnvelope(msgType, payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(signatureHeader, signature)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/hlc"
+)
+
+// NodeState ... state of one node held by syncer (copied by value, never shared)
+type NodeState struct {
+	Count     int64         `json:"count"`
+	CreatedAt int64         `json:"created_at"`
+	UpdatedAt hlc.Timestamp `json:"updated_at"`
+	Reachable bool          `json:"reachable"`
+}
+
+// SyncState ... snapshot of syncer state
+// スナップショットは複数の goroutine から参照されるため書き換えてはいけない
+type SyncState struct {
+	SyncedAt int64                `json:"synced_at"`
+	Nodes    map[int]NodeState    `json:"nodes"`
+	Skew     map[int]hlc.PeerSkew `json:"skew"`
+}
+
+func (st *SyncState) clone() *SyncState {
+	next := &SyncState{
+		SyncedAt: st.SyncedAt,
+		Nodes:    make(map[int]NodeState, len(st.Nodes)),
+		Skew:     make(map[int]hlc.PeerSkew, len(st.Skew)),
+	}
+	for port, node := range st.Nodes {
+		next.Nodes[port] = node
+	}
+	for port, skew := range st.Skew {
+		next.Skew[port] = skew
+	}
+	return next
+}
+
+// SyncStore ... copy-on-write store of syncer state
+// 読み取りはロックを取らずにスナップショットを参照し、更新は mutex の下でコピーを作って差し替える
+type SyncStore struct {
+	mu    *sync.Mutex
+	state atomic.Value // *SyncState
+}
+
+func newSyncStore() *SyncStore {
+	ss := &SyncStore{mu: &sync.Mutex{}}
+	ss.state.Store(&SyncState{
+		SyncedAt: time.Now().UnixNano(),
+		Nodes:    map[int]NodeState{},
+		Skew:     map[int]hlc.PeerSkew{},
+	})
+	return ss
+}
+
+// snapshot ... current state (read only)
+func (ss *SyncStore) snapshot() *SyncState {
+	return ss.state.Load().(*SyncState)
+}
+
+// update ... apply fn to copy of current state and publish it atomically
+func (ss *SyncStore) update(fn func(st *SyncState)) *SyncState {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	next := ss.snapshot().clone()
+	fn(next)
+	ss.state.Store(next)
+	return next
+}
+
+// merge ... adopt entries newer than ours and return number of adopted entries
+// 自ノードのエントリは自ノードだけが更新する
+func (ss *SyncStore) merge(entries map[int]NodeState) int {
+	if len(entries) == 0 {
+		return 0
+	}
+	merged := 0
+	ss.update(func(st *SyncState) {
+		for port, in := range entries {
+			if port == listenPort {
+				continue
+			}
+			node, ok := st.Nodes[port]
+			if !ok {
+				in.Reachable = true
+			} else if !node.UpdatedAt.Less(in.UpdatedAt) {
+				// 各ホストの時計のずれの影響を受けないように HLC で比較する
+				continue
+			}
+			st.Nodes[port] = in
+			merged++
+		}
+	})
+	return merged
+}
+
+// setLocal ... publish state of this node
+func (ss *SyncStore) setLocal(port int, node NodeState) {
+	ss.update(func(st *SyncState) {
+		st.SyncedAt = time.Now().UnixNano()
+		st.Nodes[port] = node
+	})
+}
+
+// addPeers ... register peers which are not known yet
+// 相手から届く状態より常に古くなるようにゼロ値の HLC とする
+func (ss *SyncStore) addPeers(ports []int) {
+	ss.update(func(st *SyncState) {
+		for _, port := range ports {
+			if _, ok := st.Nodes[port]; !ok {
+				st.Nodes[port] = NodeState{CreatedAt: time.Now().UnixNano(), Reachable: true}
+			}
+		}
+	})
+}
+
+func (ss *SyncStore) setReachable(port int, r bool) {
+	ss.update(func(st *SyncState) {
+		if node, ok := st.Nodes[port]; ok {
+			node.Reachable = r
+			st.Nodes[port] = node
+		}
+	})
+}
+
+// setSkew ... record skew observed in exchange (keeps count of stale messages)
+func (ss *SyncStore) setSkew(port int, skew hlc.PeerSkew) {
+	ss.update(func(st *SyncState) {
+		skew.Stale = st.Skew[port].Stale
+		st.Skew[port] = skew
+	})
+}
+
+// addStale ... record skew of peer whose message was rejected as stale
+func (ss *SyncStore) addStale(port int, skew hlc.PeerSkew) {
+	ss.update(func(st *SyncState) {
+		skew.Stale = st.Skew[port].Stale + 1
+		st.Skew[port] = skew
+	})
+}
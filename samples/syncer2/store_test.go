@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miyaz/go-examples/internal/hlc"
+)
+
+// setupSyncer ... fresh global state of this node listening on port 9000
+func setupSyncer(t *testing.T) {
+	t.Helper()
+	listenPort = 9000
+	syncOption.Secret = "test"
+	syncOption.MaxBytes = 0
+	syncOption.ReplayWindow = 30 * time.Second
+	syncer = newSyncStore()
+	store.node = &NodeInfo{&sync.RWMutex{}, 0, time.Now().UnixNano(), clock.Now(), true}
+	syncer.setLocal(listenPort, store.node.getState())
+}
+
+func TestSyncStoreConcurrent(t *testing.T) {
+	setupSyncer(t)
+	peers := []int{9001, 9002, 9003, 9004}
+	const rounds = 200
+
+	wg := &sync.WaitGroup{}
+	// 各ピアの状態を古いものと新しいものを混ぜて merge する
+	for _, port := range peers {
+		for _, reverse := range []bool{false, true} {
+			wg.Add(1)
+			go func(port int, reverse bool) {
+				defer wg.Done()
+				for i := 1; i <= rounds; i++ {
+					version := i
+					if reverse {
+						version = rounds + 1 - i
+					}
+					syncer.merge(map[int]NodeState{
+						port: {Count: int64(version), UpdatedAt: hlc.Timestamp{Wall: int64(version)}},
+						// 自ノードのエントリは merge で上書きされない
+						listenPort: {Count: -1, UpdatedAt: hlc.Timestamp{Wall: 1 << 62}},
+					})
+				}
+			}(port, reverse)
+		}
+	}
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			store.node.countUp()
+			updateSyncer()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			syncer.setReachable(peers[i%len(peers)], i%2 == 0)
+			syncer.setSkew(peers[i%len(peers)], hlc.PeerSkew{RTT: float64(i)})
+			syncer.addPeers([]int{9005 + i%3})
+		}
+	}()
+	// 1 つの reader から見たバージョンは巻き戻らない
+	go func() {
+		defer wg.Done()
+		seen := map[int]hlc.Timestamp{}
+		for i := 0; i < rounds*4; i++ {
+			snap := syncer.snapshot()
+			for port, node := range snap.Nodes {
+				if node.UpdatedAt.Less(seen[port]) {
+					t.Errorf("version of %d went back from %v to %v", port, seen[port], node.UpdatedAt)
+				}
+				seen[port] = node.UpdatedAt
+			}
+			for range snap.Skew {
+			}
+			makeDelta(makeDigest(), 0)
+		}
+	}()
+	wg.Wait()
+
+	snap := syncer.snapshot()
+	for _, port := range peers {
+		if node := snap.Nodes[port]; node.Count != rounds {
+			t.Errorf("count of %d = %d, want %d", port, node.Count, rounds)
+		}
+	}
+	if node := snap.Nodes[listenPort]; node.Count != rounds {
+		t.Errorf("count of this node = %d, want %d", node.Count, rounds)
+	}
+}
+
+func TestSyncerHandlerConcurrent(t *testing.T) {
+	setupSyncer(t)
+	srv := httptest.NewServer(http.HandlerFunc(syncerHandler))
+	defer srv.Close()
+	const workers, rounds = 8, 20
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			port := 9100 + w
+			for i := 1; i <= rounds; i++ {
+				resp, _, _, err := exchange(srv.URL, msgDigest, &SyncMessage{Digest: makeDigest()})
+				if err != nil {
+					t.Errorf("digest: %v", err)
+					return
+				}
+				syncer.merge(resp.Entries)
+				entries := map[int]NodeState{port: {Count: int64(i), UpdatedAt: clock.Now()}}
+				if _, _, _, err := exchange(srv.URL, msgDelta, &SyncMessage{Entries: entries}); err != nil {
+					t.Errorf("delta: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < workers*rounds; i++ {
+			updateSyncer()
+			syncer.snapshot()
+		}
+	}()
+	wg.Wait()
+
+	snap := syncer.snapshot()
+	for w := 0; w < workers; w++ {
+		if node := snap.Nodes[9100+w]; node.Count != rounds {
+			t.Errorf("count of %d = %d, want %d", 9100+w, node.Count, rounds)
+		}
+	}
+	if got := store.node.getCount(); got != workers*rounds*2 {
+		t.Errorf("count of verified requests = %d, want %d", got, workers*rounds*2)
+	}
+}
+
+func TestSyncerHandlerRejects(t *testing.T) {
+	setupSyncer(t)
+	post := func(body []byte, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/syncer/", bytes.NewBuffer(body))
+		req.Header.Set(signatureHeader, signature)
+		rec := httptest.NewRecorder()
+		syncerHandler(rec, req)
+		return rec.Code
+	}
+	body, signature, err := encodeEnvelope(msgDelta, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append(append([]byte{}, body...), ' ')
+	if code := post(tampered, signature); code != http.StatusUnauthorized {
+		t.Errorf("invalid signature: status = %d, want 401", code)
+	}
+	if code := post(body, signature); code != http.StatusOK {
+		t.Errorf("first delivery: status = %d, want 200", code)
+	}
+	if code := post(body, signature); code != http.StatusUnauthorized {
+		t.Errorf("replay: status = %d, want 401", code)
+	}
+	// 検証に通ったリクエストのみカウントする
+	if got := store.node.getCount(); got != 1 {
+		t.Errorf("count = %d, want 1", got)
+	}
+}
+
+// newLaggingPeer ... peer whose physical clock runs lag behind this node
+func newLaggingPeer(t *testing.T, port int, lag time.Duration) *httptest.Server {
+	t.Helper()
+	physical := func() int64 { return time.Now().UnixNano() - int64(lag) }
+	peerClock := hlc.NewClockWithSource(physical)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		in := &Envelope{}
+		if err := json.Unmarshal(body, in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		peerClock.Update(in.Clock)
+		out, _ := json.Marshal(Envelope{
+			Version: protocolVersion, From: port, Type: msgDelta, Clock: peerClock.Now(),
+			Timestamp: physical(), Nonce: newNonce(), Payload: []byte(`{}`),
+		})
+		w.Header().Set(signatureHeader, hex.EncodeToString(sign(out)))
+		w.Write(out)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSkewOfLaggingPeer(t *testing.T) {
+	setupSyncer(t)
+	const port = 9200
+	srv := newLaggingPeer(t, port, 5*time.Second)
+	for i := 0; i < 5; i++ {
+		if _, _, _, err := exchange(srv.URL, msgDigest, &SyncMessage{Digest: makeDigest()}); err != nil {
+			t.Fatalf("round %d: %v", i, err)
+		}
+		// 相手の HLC はこちらに追いつくが、報告するずれは遅れたまま
+		if skew := syncer.snapshot().Skew[port]; skew.Offset > -4900 || skew.Offset < -5100 {
+			t.Errorf("round %d: offset = %vms, want about -5000ms", i, skew.Offset)
+		}
+	}
+}
+
+func TestSyncerHandlerAcceptsPeerAfterStale(t *testing.T) {
+	setupSyncer(t)
+	const port, lag = 9300, time.Minute
+	physical := func() int64 { return time.Now().UnixNano() - int64(lag) }
+	peerClock := hlc.NewClockWithSource(physical)
+	post := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(Envelope{
+			Version: protocolVersion, From: port, Type: msgDelta, Clock: peerClock.Now(),
+			Timestamp: physical(), Nonce: newNonce(), Payload: []byte(`{}`),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/syncer/", bytes.NewBuffer(body))
+		req.Header.Set(signatureHeader, hex.EncodeToString(sign(body)))
+		rec := httptest.NewRecorder()
+		syncerHandler(rec, req)
+		return rec
+	}
+
+	// ReplayWindow より遅れた HLC は 409 で拒否し、時計のずれとして記録する
+	rec := post()
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("stale delivery: status = %d, want 409", rec.Code)
+	}
+	skew := syncer.snapshot().Skew[port]
+	if skew.Stale != 1 || skew.Offset > -59900 || skew.Offset < -60100 {
+		t.Errorf("skew = %+v, want 1 stale message at about -60000ms", skew)
+	}
+	env, err := decodeEnvelope(rec.Body.Bytes(), rec.Header().Get(signatureHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 返された HLC に追いつけば、物理時刻が遅れたままでも受け付けられる
+	peerClock.Update(env.Clock)
+	if rec := post(); rec.Code != http.StatusOK {
+		t.Errorf("delivery after catching up: status = %d, want 200", rec.Code)
+	}
+	if got := store.node.getCount(); got != 1 {
+		t.Errorf("count = %d, want 1", got)
+	}
+}
@@ -5,12 +5,12 @@ import (
 	"log"
 	"time"
 
-	linuxproc "github.com/c9s/goprocinfo/linux"
+	"github.com/miyaz/go-examples/internal/sampler"
 )
 
 func main() {
 	for {
-		vmstat, err := linuxproc.ReadVMStat("/proc/vmstat")
+		vmstat, err := sampler.ReadVMStat(sampler.DefaultRoot)
 		if err != nil {
 			log.Fatal("vmstat read fail")
 		}